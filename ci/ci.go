@@ -1,11 +1,10 @@
 package ci
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"os"
-	"text/template"
+	"sync"
 	"time"
 
 	"github.com/bndr/gojenkins"
@@ -41,31 +40,23 @@ type BuildServerProxy interface {
 	CreateTask(newProject data.Project) error
 }
 
-var Proxy BuildServerProxy
-
-func init() {
-	cfg := data.GetConfig()
-
-	var err error
-	Proxy, err = newJenkinsProxy(cfg.JenkinsUrl, cfg.JenkinsUsername, cfg.JenkinsPassword)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not connect to Jenkins build server: %s\n", err.Error())
-		fmt.Fprintf(os.Stderr, "Please check your connection and configuration settings\n")
-		periodicallyRecheckConnection(cfg)
-	}
-}
-
 // Proxies calls to Jenkins - allows system to run
 // when Jenkins is unavailable
 type JenkinsProxy struct {
+	mu     sync.RWMutex
 	client *gojenkins.Jenkins
+	store  data.Store
 }
 
-func newJenkinsProxy(url, username, password string) (BuildServerProxy, error) {
-	fmt.Printf("Connecting to Jenkins instance: %s\n", url)
-	proxy := &JenkinsProxy{}
-	j, err := gojenkins.CreateJenkins(url, username, password).Init()
+// Connects to the Jenkins server in cfg. If Jenkins can't be reached
+// the error is returned along with a proxy that keeps retrying in the
+// background, so the rest of goobernet can carry on without it.
+func NewJenkinsProxy(cfg data.GoobernetConfig, store data.Store) (*JenkinsProxy, error) {
+	fmt.Printf("Connecting to Jenkins instance: %s\n", cfg.JenkinsUrl)
+	proxy := &JenkinsProxy{store: store}
+	j, err := gojenkins.CreateJenkins(cfg.JenkinsUrl, cfg.JenkinsUsername, cfg.JenkinsPassword.Reveal()).Init()
 	if err != nil {
+		proxy.periodicallyRecheckConnection(cfg)
 		return proxy, err
 	}
 
@@ -73,19 +64,18 @@ func newJenkinsProxy(url, username, password string) (BuildServerProxy, error) {
 	return proxy, nil
 }
 
-func periodicallyRecheckConnection(cfg data.GoobernetConfig) {
+func (jp *JenkinsProxy) periodicallyRecheckConnection(cfg data.GoobernetConfig) {
 	go func() {
 		for {
 			select {
 			case <-time.After(1 * time.Minute):
 				fmt.Fprintf(os.Stderr, "Retrying Jenkins connection\n")
-				j, err := gojenkins.CreateJenkins(cfg.JenkinsUrl, cfg.JenkinsUsername, cfg.JenkinsPassword).Init()
+				j, err := gojenkins.CreateJenkins(cfg.JenkinsUrl, cfg.JenkinsUsername, cfg.JenkinsPassword.Reveal()).Init()
 				if err == nil {
 					fmt.Printf("Connected to Jenkins. Small miracles.\n")
-					jenkinsProxy, ok := Proxy.(*JenkinsProxy)
-					if ok {
-						jenkinsProxy.client = j
-					}
+					jp.mu.Lock()
+					jp.client = j
+					jp.mu.Unlock()
 					return
 				}
 			}
@@ -93,12 +83,22 @@ func periodicallyRecheckConnection(cfg data.GoobernetConfig) {
 	}()
 }
 
-func (jp *JenkinsProxy) GetTasks() ([]BuildTask, error) {
+func (jp *JenkinsProxy) getClient() (*gojenkins.Jenkins, error) {
+	jp.mu.RLock()
+	defer jp.mu.RUnlock()
 	if jp.client == nil {
 		return nil, errors.New("No connection to build server\n")
 	}
+	return jp.client, nil
+}
 
-	jobNames, err := jp.client.GetAllJobNames()
+func (jp *JenkinsProxy) GetTasks() ([]BuildTask, error) {
+	client, err := jp.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	jobNames, err := client.GetAllJobNames()
 	if err != nil {
 		return nil, err
 	}
@@ -113,11 +113,12 @@ func (jp *JenkinsProxy) GetTasks() ([]BuildTask, error) {
 }
 
 func (jp *JenkinsProxy) GetTaskDetails(taskName string) (*TaskDetails, error) {
-	if jp.client == nil {
-		return nil, errors.New("No connection to build server\n")
+	client, err := jp.getClient()
+	if err != nil {
+		return nil, err
 	}
 
-	job, err := jp.client.GetJob(taskName)
+	job, err := client.GetJob(taskName)
 	if err != nil {
 		return nil, err
 	}
@@ -148,35 +149,56 @@ func (jp *JenkinsProxy) GetTaskDetails(taskName string) (*TaskDetails, error) {
 }
 
 func (jp *JenkinsProxy) CreateTask(newProject data.Project) error {
-	if jp.client == nil {
-		return errors.New("No connection to build server\n")
+	client, err := jp.getClient()
+	if err != nil {
+		return err
 	}
 
-	var templ data.JenkinsTemplate
-	var err error
+	if err := data.ValidateProject(newProject); err != nil {
+		return err
+	}
+	if existing, err := jp.store.GetProjectByShortName(newProject.ShortName); err == nil {
+		return fmt.Errorf("Project '%s' already exists with id: %d", existing.ShortName, existing.Id)
+	}
 
-	templ = newProject.BuildTemplate
+	var templ data.JenkinsTemplate
 
-	var t *template.Template
-	if t, err = template.New("Build template").Parse(templ.Content); err != nil {
+	if templ, err = ResolveTemplate(jp.store, newProject.BuildTemplate); err != nil {
 		return err
 	}
+	newProject.BuildTemplate = templ
 
-	buf := new(bytes.Buffer)
-	err = t.Execute(buf, newProject)
-	if err != nil {
+	rendered := RenderTemplate(templ, newProject)
+	if err = rendered.Err(); err != nil {
 		return err
 	}
 
-	xml := buf.String()
-	if _, err := jp.client.CreateJob(xml, newProject.ShortName); err != nil {
+	xml := rendered.Xml
+	if _, err := client.CreateJob(xml, newProject.ShortName); err != nil {
 		return err
 	}
 
 	// save our proj
-	if err := data.AddProject(newProject); err != nil {
+	if _, err := jp.store.AddProject(newProject); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// Projects may refer to a stored template by name rather than
+// embedding its content
+func ResolveTemplate(store data.Store, templ data.JenkinsTemplate) (data.JenkinsTemplate, error) {
+	if templ.Content != "" {
+		return templ, nil
+	}
+	if templ.Name == "" {
+		return templ, errors.New("Project has no build template")
+	}
+
+	stored, err := store.GetTemplateByName(templ.Name)
+	if err != nil {
+		return templ, err
+	}
+	return *stored, nil
+}
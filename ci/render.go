@@ -0,0 +1,213 @@
+package ci
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/travissimon/goobernet/data"
+)
+
+const (
+	SEVERITY_ERROR   = "error"
+	SEVERITY_WARNING = "warning"
+)
+
+// Result of rendering a build template against a project,
+// without sending anything to the build server
+type RenderResult struct {
+	Xml      string          `json:"xml"`
+	Valid    bool            `json:"valid"`
+	Problems []RenderProblem `json:"problems"`
+}
+
+type RenderProblem struct {
+	Severity string `json:"severity"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Message  string `json:"message"`
+}
+
+// text/template errors look like "template: name:line[:col]: message"
+var templateErrorPattern = regexp.MustCompile(`^template: [^:]*:(\d+)(?::(\d+))?: (.*)$`)
+
+func RenderTemplate(templ data.JenkinsTemplate, project data.Project) *RenderResult {
+	result := &RenderResult{Problems: make([]RenderProblem, 0, 5)}
+
+	t, err := template.New("Build template").Parse(templ.Content)
+	if err != nil {
+		result.addTemplateError(err)
+		return result
+	}
+
+	result.checkFields(t.Tree, templ.Content, project)
+	if result.hasErrors() {
+		// execution would only fail on the first of these
+		return result
+	}
+
+	buf := new(bytes.Buffer)
+	if err = t.Execute(buf, project); err != nil {
+		result.addTemplateError(err)
+		return result
+	}
+	result.Xml = buf.String()
+
+	result.checkXml()
+	result.Valid = !result.hasErrors()
+	return result
+}
+
+// Collapses any errors into one, for callers that just want to know
+// whether the template can be sent to the build server
+func (r *RenderResult) Err() error {
+	if !r.hasErrors() {
+		return nil
+	}
+	msgs := make([]string, 0, len(r.Problems))
+	for _, p := range r.Problems {
+		if p.Severity == SEVERITY_ERROR {
+			msgs = append(msgs, fmt.Sprintf("line %d: %s", p.Line, p.Message))
+		}
+	}
+	return fmt.Errorf("Invalid build template: %s", strings.Join(msgs, "; "))
+}
+
+func (r *RenderResult) hasErrors() bool {
+	for _, p := range r.Problems {
+		if p.Severity == SEVERITY_ERROR {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RenderResult) addTemplateError(err error) {
+	problem := RenderProblem{Severity: SEVERITY_ERROR, Message: err.Error()}
+	if m := templateErrorPattern.FindStringSubmatch(err.Error()); m != nil {
+		problem.Line, _ = strconv.Atoi(m[1])
+		problem.Column, _ = strconv.Atoi(m[2])
+		problem.Message = m[3]
+	}
+	r.Problems = append(r.Problems, problem)
+}
+
+func (r *RenderResult) checkXml() {
+	if strings.TrimSpace(r.Xml) == "" {
+		r.Problems = append(r.Problems, RenderProblem{Severity: SEVERITY_ERROR, Line: 1, Message: "Template rendered no content"})
+		return
+	}
+
+	decoder := xml.NewDecoder(strings.NewReader(r.Xml))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			problem := RenderProblem{Severity: SEVERITY_ERROR, Message: err.Error()}
+			if syntaxErr, ok := err.(*xml.SyntaxError); ok {
+				problem.Line = syntaxErr.Line
+				problem.Message = syntaxErr.Msg
+			}
+			r.Problems = append(r.Problems, problem)
+			return
+		}
+	}
+}
+
+// Walks the parsed template looking for project fields that don't
+// exist or are empty. Fields inside range/with blocks are skipped,
+// as dot no longer refers to the project there.
+func (r *RenderResult) checkFields(tree *parse.Tree, content string, project data.Project) {
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, child := range n.Nodes {
+				walk(child)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.TemplateNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, cmd := range n.Cmds {
+				walk(cmd)
+			}
+		case *parse.CommandNode:
+			for _, arg := range n.Args {
+				walk(arg)
+			}
+		case *parse.FieldNode:
+			r.checkField(n.Ident, int(n.Position()), content, project)
+		}
+	}
+	walk(tree.Root)
+}
+
+func (r *RenderResult) checkField(ident []string, pos int, content string, project data.Project) {
+	line, col := position(content, pos)
+	name := "." + strings.Join(ident, ".")
+
+	v := reflect.ValueOf(project)
+	calledMethod := false
+	for _, field := range ident {
+		if v.Kind() != reflect.Struct {
+			return
+		}
+		if f := v.FieldByName(field); f.IsValid() {
+			v = f
+			continue
+		}
+
+		// templates can call methods too, e.g. .HealthCheck.Enabled
+		m := v.MethodByName(field)
+		if !m.IsValid() {
+			if _, ok := reflect.PtrTo(v.Type()).MethodByName(field); ok {
+				return
+			}
+			r.Problems = append(r.Problems, RenderProblem{SEVERITY_ERROR, line, col, fmt.Sprintf("Project has no field or method %s", name)})
+			return
+		}
+		if m.Type().NumIn() != 0 || m.Type().NumOut() == 0 {
+			// takes arguments, which the template's execution checks
+			return
+		}
+		v = m.Call(nil)[0]
+		calledMethod = true
+	}
+
+	// a method's zero result, like false, is an answer rather than a gap
+	if !calledMethod && v.IsZero() {
+		r.Problems = append(r.Problems, RenderProblem{SEVERITY_WARNING, line, col, fmt.Sprintf("Field %s is empty", name)})
+	}
+}
+
+// converts a byte offset into a 1-based line and column
+func position(content string, pos int) (int, int) {
+	if pos > len(content) {
+		pos = len(content)
+	}
+	before := content[:pos]
+	line := strings.Count(before, "\n") + 1
+	col := pos - strings.LastIndex(before, "\n")
+	return line, col
+}
@@ -0,0 +1,105 @@
+package ci
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/travissimon/goobernet/data"
+)
+
+// A problem RenderTemplate should report, matched on part of its message
+type wantProblem struct {
+	severity string
+	line     int
+	message  string
+}
+
+func TestRenderTemplate(t *testing.T) {
+	project := data.Project{
+		Name:        "Billing",
+		ShortName:   "billing",
+		GithubUrl:   "https://github.com/example/billing",
+		HealthCheck: data.HealthCheck{Type: data.HEALTH_TCP},
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		wantXml string
+		want    []wantProblem
+	}{
+		{
+			name:    "renders",
+			content: "<project>\n  <name>{{.ShortName}}</name>\n</project>",
+			wantXml: "<project>\n  <name>billing</name>\n</project>",
+		},
+		{
+			name:    "method reference",
+			content: "<project>{{if .HealthCheck.Enabled}}checked{{end}}</project>",
+			wantXml: "<project>checked</project>",
+		},
+		{
+			name:    "unknown field",
+			content: "<project>\n{{.Repository}}</project>",
+			want:    []wantProblem{{SEVERITY_ERROR, 2, ".Repository"}},
+		},
+		{
+			name:    "unknown nested field",
+			content: "<project>{{.HealthCheck.Url}}</project>",
+			want:    []wantProblem{{SEVERITY_ERROR, 1, ".HealthCheck.Url"}},
+		},
+		{
+			name:    "empty field",
+			content: "<project>{{.Email}}</project>",
+			wantXml: "<project></project>",
+			want:    []wantProblem{{SEVERITY_WARNING, 1, ".Email is empty"}},
+		},
+		{
+			name:    "fields inside range are skipped",
+			content: "<project>{{range .HealthCheck.Command}}{{.Whatever}}{{end}}</project>",
+			wantXml: "<project></project>",
+		},
+		{
+			name:    "template syntax",
+			content: "<project>\n{{.Name</project>",
+			want:    []wantProblem{{SEVERITY_ERROR, 2, ""}},
+		},
+		{
+			name:    "invalid xml",
+			content: "<project>\n<name>{{.Name}}</nom>\n</project>",
+			want:    []wantProblem{{SEVERITY_ERROR, 2, ""}},
+		},
+		{
+			name:    "no content",
+			content: "{{if .Email}}<project/>{{end}}",
+			want:    []wantProblem{{SEVERITY_WARNING, 1, ".Email is empty"}, {SEVERITY_ERROR, 1, "no content"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := RenderTemplate(data.JenkinsTemplate{Name: "t", Content: test.content}, project)
+
+			if test.wantXml != "" && r.Xml != test.wantXml {
+				t.Errorf("Xml = %q, want %q", r.Xml, test.wantXml)
+			}
+			if len(r.Problems) != len(test.want) {
+				t.Fatalf("Problems = %+v, want %d", r.Problems, len(test.want))
+			}
+			hasError := false
+			for i, want := range test.want {
+				p := r.Problems[i]
+				if p.Severity != want.severity || p.Line != want.line || !strings.Contains(p.Message, want.message) {
+					t.Errorf("problem %d = %+v, want %+v", i, p, want)
+				}
+				hasError = hasError || p.Severity == SEVERITY_ERROR
+			}
+			if r.Valid == hasError {
+				t.Errorf("Valid = %v with problems %+v", r.Valid, r.Problems)
+			}
+			if (r.Err() != nil) != hasError {
+				t.Errorf("Err() = %v, want an error %v", r.Err(), hasError)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/travissimon/goobernet/data"
+	"github.com/travissimon/goobernet/docker"
+)
+
+// Flags shared by the server and the config command
+type storeOptions struct {
+	storeType     *string
+	configDir     *string
+	dbPath        *string
+	secretKeyFile *string
+}
+
+func addStoreFlags(fs *flag.FlagSet) storeOptions {
+	return storeOptions{
+		storeType:     fs.String("store", "json", "Where to keep state: json or sqlite"),
+		configDir:     fs.String("config-dir", data.ConfigDir(), "Directory holding goobernet's state (or set GOOBERNET_CONFIG_DIR)"),
+		dbPath:        fs.String("db", "", "SQLite database file, used with -store=sqlite (default <config-dir>/goobernet.db)"),
+		secretKeyFile: fs.String("secret-key-file", "", "File holding the key secrets are encrypted with (or set GOOBERNET_SECRET_KEY_FILE or GOOBERNET_SECRET_KEY)"),
+	}
+}
+
+// Flags shared by the server and the plan command
+type dockerOptions struct {
+	endpoint *string
+	instance *string
+}
+
+func addDockerFlags(fs *flag.FlagSet) dockerOptions {
+	return dockerOptions{
+		endpoint: fs.String("docker", "unix:///var/run/docker.sock", "Docker daemon to manage containers on"),
+		instance: fs.String("instance", defaultInstance(), "Name this goobernet's containers are labelled with"),
+	}
+}
+
+// the host name, as there's usually one goobernet per docker host
+func defaultInstance() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "goobernet"
+	}
+	return host
+}
+
+func (o dockerOptions) connect() (*docker.Client, error) {
+	return docker.NewClient(*o.endpoint, *o.instance)
+}
+
+// Opens the store only if it's already there, and without writing to
+// it, for commands that mustn't change anything
+func (o storeOptions) openReadOnly() (data.Store, error) {
+	path := *o.configDir
+	if *o.storeType == "sqlite" {
+		path = *o.dbPath
+		if path == "" {
+			path = filepath.Join(*o.configDir, "goobernet.db")
+		}
+	}
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("No %s store at %s", *o.storeType, path)
+		}
+		return nil, err
+	}
+
+	if *o.storeType == "json" {
+		return warnOpened(data.OpenReadOnly(path))
+	}
+	sqlStore, err := data.OpenSqlStoreReadOnly(path)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := sqlStore.JsonImportPending(*o.configDir)
+	if err == nil && pending {
+		err = fmt.Errorf("JSON config in %s hasn't been imported yet; start goobernet first", *o.configDir)
+	}
+	if err != nil {
+		sqlStore.Close()
+		return nil, err
+	}
+	return sqlStore, nil
+}
+
+func (o storeOptions) open() (data.Store, error) {
+	switch *o.storeType {
+	case "json":
+		return warnOpened(data.Open(*o.configDir))
+	case "sqlite":
+		dbPath := *o.dbPath
+		if dbPath == "" {
+			if err := os.MkdirAll(*o.configDir, 0755); err != nil {
+				return nil, err
+			}
+			dbPath = filepath.Join(*o.configDir, "goobernet.db")
+		}
+		sqlStore, err := data.OpenSqlStore(dbPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := sqlStore.ImportJson(*o.configDir); err != nil {
+			sqlStore.Close()
+			return nil, fmt.Errorf("Error importing JSON config: %s", err.Error())
+		}
+		return sqlStore, nil
+	}
+	return nil, fmt.Errorf("Unknown store type '%s'", *o.storeType)
+}
+
+// Prints what was wrong with a JSON store that opened anyway
+func warnOpened(js *data.JsonStore, err error) (data.Store, error) {
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range js.Warnings() {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	return js, nil
+}
+
+// Returns the config with secrets decrypted and environment overrides
+// applied. Secrets still stored as plain text are encrypted on the way.
+func (o storeOptions) loadConfig(store data.Store) (data.GoobernetConfig, error) {
+	key, err := data.LoadSecretKey(*o.secretKeyFile)
+	if err != nil {
+		return data.GoobernetConfig{}, err
+	}
+
+	if key == nil {
+		fmt.Fprintf(os.Stderr, "No secret key configured, secrets in config are not encrypted\n")
+	} else {
+		encrypted, err := key.EncryptStoredSecrets(store)
+		if err != nil {
+			return data.GoobernetConfig{}, err
+		}
+		if encrypted {
+			fmt.Printf("Encrypted plain text secrets in config\n")
+		}
+	}
+
+	stored, err := store.GetConfig()
+	if err != nil {
+		return data.GoobernetConfig{}, err
+	}
+	cfg, err := key.DecryptConfig(stored)
+	if err != nil {
+		return data.GoobernetConfig{}, err
+	}
+	return cfg.WithEnvOverrides(), nil
+}
+
+const configUsage = `Usage:
+  goobernet config set-secret [flags] <name> [value]
+      Encrypts and saves a secret, e.g. jenkinsPassword. The value is
+      read from stdin if not given.
+  goobernet config registry-login [flags] <registry> <username> [password]
+      Encrypts and saves the credentials used to pull images from
+      registry. The password is read from stdin if not given.
+  goobernet config gen-key
+      Prints a new random secret key.
+`
+
+// handles `goobernet config ...`, returning the exit code
+func configCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, configUsage)
+		return 2
+	}
+
+	switch args[0] {
+	case "set-secret":
+		return setSecretCommand(args[1:])
+	case "registry-login":
+		return registryLoginCommand(args[1:])
+	case "gen-key":
+		key, err := data.GenerateSecretKey()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error generating key: %s\n", err.Error())
+			return 1
+		}
+		fmt.Println(key)
+		return 0
+	}
+
+	fmt.Fprint(os.Stderr, configUsage)
+	return 2
+}
+
+func setSecretCommand(args []string) int {
+	fs := flag.NewFlagSet("config set-secret", flag.ExitOnError)
+	opts := addStoreFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fmt.Fprint(os.Stderr, configUsage)
+		return 2
+	}
+	name := fs.Arg(0)
+
+	var value string
+	if fs.NArg() == 2 {
+		value = fs.Arg(1)
+	} else {
+		var err error
+		if value, err = readSecret(name); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading value: %s\n", err.Error())
+			return 1
+		}
+	}
+
+	key, err := data.LoadSecretKey(*opts.secretKeyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	secret, err := key.Encrypt(value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	store, err := opts.open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config data: %s\n", err.Error())
+		return 1
+	}
+
+	cfg, err := store.GetConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %s\n", err.Error())
+		return 1
+	}
+	if err := cfg.SetSecret(name, secret); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	if err := store.SaveConfig(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving config: %s\n", err.Error())
+		return 1
+	}
+
+	fmt.Printf("Saved %s\n", name)
+	return 0
+}
+
+func registryLoginCommand(args []string) int {
+	fs := flag.NewFlagSet("config registry-login", flag.ExitOnError)
+	opts := addStoreFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() < 2 || fs.NArg() > 3 {
+		fmt.Fprint(os.Stderr, configUsage)
+		return 2
+	}
+	registry, username := fs.Arg(0), fs.Arg(1)
+
+	var password string
+	if fs.NArg() == 3 {
+		password = fs.Arg(2)
+	} else {
+		var err error
+		if password, err = readSecret("password for " + registry); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading password: %s\n", err.Error())
+			return 1
+		}
+	}
+
+	key, err := data.LoadSecretKey(*opts.secretKeyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	secret, err := key.Encrypt(password)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	store, err := opts.open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config data: %s\n", err.Error())
+		return 1
+	}
+
+	cfg, err := store.GetConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %s\n", err.Error())
+		return 1
+	}
+	cfg.SetRegistryAuth(data.RegistryAuth{Registry: registry, Username: username, Password: secret})
+	if err := store.SaveConfig(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving config: %s\n", err.Error())
+		return 1
+	}
+
+	fmt.Printf("Saved credentials for %s\n", registry)
+	return 0
+}
+
+// Prompts for a value on stdin, which keeps it out of shell history
+func readSecret(name string) (string, error) {
+	fmt.Fprintf(os.Stderr, "Enter value for %s: ", name)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/travissimon/goobernet/data"
+)
+
+const CONFIG_PATH = "/v1/config/"
+
+type configValuesResponse struct {
+	Environment string            `json:"environment"`
+	Project     string            `json:"project,omitempty"`
+	Defaults    map[string]string `json:"defaults"`
+	Overrides   map[string]string `json:"overrides,omitempty"`
+	Effective   map[string]string `json:"effective"`
+}
+
+// handles requests for /v1/config/(environment-name) and
+// /v1/config/(environment-name)/(project-short-name)
+func configValuesHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path[len(CONFIG_PATH):], "/")
+	if len(parts) > 2 || parts[0] == "" {
+		writeError(w, http.StatusNotFound, "Expected %s(environment)[/(project)]\n", CONFIG_PATH)
+		return
+	}
+
+	environment, err := store.GetEnvironmentByName(parts[0])
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+	// no project means the environment-wide defaults
+	var project data.Project
+	if len(parts) == 2 {
+		if project, err = store.GetProjectByShortName(parts[1]); err != nil {
+			writeError(w, http.StatusNotFound, "%s\n", err.Error())
+			return
+		}
+	}
+
+	switch r.Method {
+	case "GET":
+		handleGetConfigValues(environment, project, w)
+	case "PUT":
+		handlePutConfigValues(environment, project, w, r)
+	case "DELETE":
+		handleDeleteConfigValues(environment, project, w)
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+func handleGetConfigValues(environment data.Environment, project data.Project, w http.ResponseWriter) {
+	defaults, err := store.GetConfigValues(environment.Id, 0)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%s\n", err.Error())
+		return
+	}
+	resp := configValuesResponse{
+		Environment: environment.Name,
+		Defaults:    defaults,
+	}
+	resp.Effective = resp.Defaults
+	if project.Id != 0 {
+		resp.Project = project.ShortName
+		if resp.Overrides, err = store.GetConfigValues(environment.Id, project.Id); err != nil {
+			writeError(w, http.StatusInternalServerError, "%s\n", err.Error())
+			return
+		}
+		effective, err := data.EnvironmentVars(store, data.Deployment{Project: project, Environment: environment})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "%s\n", err.Error())
+			return
+		}
+		resp.Effective = effective
+	}
+	marshalAndWrite(resp, w)
+}
+
+// replaces all values with the {"NAME": "value"} body
+func handlePutConfigValues(environment data.Environment, project data.Project, w http.ResponseWriter, r *http.Request) {
+	var values map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+		writeError(w, http.StatusBadRequest, "Error decoding config values json: %s\n", err.Error())
+		return
+	}
+	if err := data.ValidateConfigValues(values); err != nil {
+		writeError(w, http.StatusBadRequest, "%s\n", err.Error())
+		return
+	}
+	if err := store.SetConfigValues(environment.Id, project.Id, values); err != nil {
+		writeError(w, http.StatusInternalServerError, "Error saving config values: %s\n", err.Error())
+		return
+	}
+	handleGetConfigValues(environment, project, w)
+}
+
+func handleDeleteConfigValues(environment data.Environment, project data.Project, w http.ResponseWriter) {
+	if err := store.DeleteConfigValues(environment.Id, project.Id); err != nil {
+		writeError(w, http.StatusInternalServerError, "Error deleting config values: %s\n", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
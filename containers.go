@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/travissimon/goobernet/data"
+	"github.com/travissimon/goobernet/docker"
+)
+
+const CONTAINERS_PATH = "/v1/containers/"
+
+type containerStatus struct {
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Running bool   `json:"running"`
+}
+
+// ?project= (short name or id), ?environment= and ?managed=true limit
+// the list to goobernet's own containers, using the labels it sets.
+// ?managed=false lists everything else.
+func getContainersHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	labels := make(map[string]string)
+	if project := query.Get("project"); project != "" {
+		if _, err := parseId(project); err == nil {
+			labels[docker.LABEL_PROJECT_ID] = project
+		} else {
+			labels[docker.LABEL_PROJECT] = project
+		}
+	}
+	if environment := query.Get("environment"); environment != "" {
+		labels[docker.LABEL_ENVIRONMENT] = environment
+	}
+	managed := query.Get("managed")
+	if managed == "true" {
+		labels[docker.LABEL_INSTANCE] = dockerClient.Instance()
+	}
+
+	containers, err := dockerClient.GetContainers(labels)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error retrieving docker containers: %s\n", err)
+		return
+	}
+
+	if managed == "false" {
+		unmanaged := make([]docker.Container, 0, len(containers))
+		for _, c := range containers {
+			if c.Label(docker.LABEL_INSTANCE) != dockerClient.Instance() {
+				unmanaged = append(unmanaged, c)
+			}
+		}
+		containers = unmanaged
+	}
+
+	environments, err := store.GetEnvironments()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%s\n", err.Error())
+		return
+	}
+	environmentIds := make(map[string]uint)
+	for _, e := range environments {
+		environmentIds[e.Name] = e.Id
+	}
+	for i := range containers {
+		containers[i].Health = containerHealth(containers[i], environmentIds)
+	}
+	marshalAndWrite(containers, w)
+}
+
+// The health of the deployment a container is serving, found through
+// its labels. Containers part way through a blue/green deploy, or
+// belonging to another goobernet, have none.
+func containerHealth(c docker.Container, environmentIds map[string]uint) string {
+	if c.Label(docker.LABEL_INSTANCE) != dockerClient.Instance() {
+		return ""
+	}
+	environment := c.Label(docker.LABEL_ENVIRONMENT)
+	environmentId, ok := environmentIds[environment]
+	if !ok || c.Name != environment+"-"+c.Label(docker.LABEL_PROJECT) {
+		return ""
+	}
+	projectId, err := parseId(c.Label(docker.LABEL_PROJECT_ID))
+	if err != nil {
+		return ""
+	}
+	status, ok := checker.Status(environmentId, projectId)
+	if !ok {
+		return ""
+	}
+	return status.Status
+}
+
+// handles requests for /v1/containers/(id or name) and
+// /v1/containers/(id or name)/(start|stop|restart|logs|stats)
+func containerHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path[len(CONTAINERS_PATH):], "/")
+	if len(parts) > 2 || parts[0] == "" {
+		writeError(w, http.StatusNotFound, "Expected %s(container)[/(action)]\n", CONTAINERS_PATH)
+		return
+	}
+	id := parts[0]
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case "GET":
+			handleGetContainer(id, w)
+		case "DELETE":
+			handleDeleteContainer(id, w, r)
+		default:
+			writeMethodNotAllowed(w, r)
+		}
+		return
+	}
+
+	switch parts[1] {
+	case "logs", "stats":
+		if r.Method != "GET" {
+			writeMethodNotAllowed(w, r)
+			return
+		}
+		if parts[1] == "logs" {
+			handleContainerLogs(id, w, r)
+		} else {
+			handleContainerStats(id, w)
+		}
+		return
+	}
+
+	if r.Method != "POST" {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	switch parts[1] {
+	case "start":
+		handleContainerAction(id, w, func() error {
+			return recordStopped(id, false, func() error {
+				return dockerClient.StartContainer(id)
+			})
+		})
+	case "stop", "restart":
+		timeout, err := parseStopTimeout(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "%s\n", err.Error())
+			return
+		}
+		handleContainerAction(id, w, func() error {
+			if parts[1] == "stop" {
+				return recordStopped(id, true, func() error {
+					return dockerClient.StopContainer(id, timeout)
+				})
+			}
+			return recordStopped(id, false, func() error {
+				return dockerClient.RestartContainer(id, timeout)
+			})
+		})
+	default:
+		writeError(w, http.StatusNotFound, "Unknown container action '%s'\n", parts[1])
+	}
+}
+
+// ?timeout= overrides the -stop-timeout seconds
+func parseStopTimeout(r *http.Request) (uint, error) {
+	timeoutStr := r.URL.Query().Get("timeout")
+	if timeoutStr == "" {
+		return stopTimeout, nil
+	}
+	timeout, err := strconv.ParseUint(timeoutStr, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a valid timeout in seconds", timeoutStr)
+	}
+	return uint(timeout), nil
+}
+
+func handleGetContainer(id string, w http.ResponseWriter) {
+	container, err := dockerClient.FindContainer(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error inspecting container: %s\n", err.Error())
+		return
+	}
+	if container == nil {
+		writeError(w, http.StatusNotFound, "Unable to find container: %s\n", id)
+		return
+	}
+	marshalAndWrite(containerStatus{container.ID, strings.TrimPrefix(container.Name, "/"), container.State.Status, container.State.Running}, w)
+}
+
+// The deployment the container serves, if it's one of ours
+func containerDeployment(id string) (data.Deployment, bool, error) {
+	container, err := dockerClient.FindContainer(id)
+	if err != nil || container == nil || container.Config == nil {
+		return data.Deployment{}, false, err
+	}
+	labels := container.Config.Labels
+	if labels[docker.LABEL_INSTANCE] != dockerClient.Instance() {
+		return data.Deployment{}, false, nil
+	}
+	environment, err := store.GetEnvironmentByName(labels[docker.LABEL_ENVIRONMENT])
+	if err != nil {
+		return data.Deployment{}, false, nil
+	}
+	projectId, err := parseId(labels[docker.LABEL_PROJECT_ID])
+	if err != nil {
+		return data.Deployment{}, false, nil
+	}
+	d, err := store.GetDeployment(environment.Id, projectId)
+	if err != nil || strings.TrimPrefix(container.Name, "/") != docker.DeploymentContainerName(d) {
+		return data.Deployment{}, false, nil
+	}
+	return d, true, nil
+}
+
+// Runs action against the container. If it serves a deployment, the
+// deployment first records whether it's meant to be stopped, so the
+// reconciler doesn't undo the action.
+func recordStopped(id string, stopped bool, action func() error) error {
+	deployLock.Lock()
+	defer deployLock.Unlock()
+
+	d, ok, err := containerDeployment(id)
+	if err != nil {
+		return err
+	}
+	changed := ok && d.Stopped != stopped
+	if changed {
+		if err := store.SetDeploymentStopped(d.Environment.Id, d.Project.Id, stopped); err != nil {
+			return err
+		}
+	}
+	if err := action(); err != nil {
+		if changed {
+			store.SetDeploymentStopped(d.Environment.Id, d.Project.Id, d.Stopped)
+		}
+		return err
+	}
+	return nil
+}
+
+// runs action against the container, then reports its new state
+func handleContainerAction(id string, w http.ResponseWriter, action func() error) {
+	if err := action(); err != nil {
+		if docker.IsNoSuchContainer(err) {
+			writeError(w, http.StatusNotFound, "Unable to find container: %s\n", id)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "%s\n", err.Error())
+		return
+	}
+	handleGetContainer(id, w)
+}
+
+// ?force=true removes the container even if it's running
+func handleDeleteContainer(id string, w http.ResponseWriter, r *http.Request) {
+	force := r.URL.Query().Get("force") == "true"
+	err := recordStopped(id, true, func() error {
+		return dockerClient.RemoveContainer(id, force)
+	})
+	if err != nil {
+		if docker.IsNoSuchContainer(err) {
+			writeError(w, http.StatusNotFound, "Unable to find container: %s\n", id)
+			return
+		}
+		writeError(w, http.StatusConflict, "Error removing container: %s\n", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
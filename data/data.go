@@ -4,18 +4,48 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"sort"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type GoobernetConfig struct {
-	JenkinsUrl      string `json:"jenkinsUrl"`
-	JenkinsUsername string `json:"jenkinsUsername"`
-	JenkinsPassword string `json:"jenkinsPassword"`
-	Registry        string `string:"registry"`
+	JenkinsUrl      string         `json:"jenkinsUrl"`
+	JenkinsUsername string         `json:"jenkinsUsername"`
+	JenkinsPassword Secret         `json:"jenkinsPassword"`
+	Registry        string         `string:"registry"`
+	RegistryAuth    []RegistryAuth `json:"registryAuth"`
+}
+
+// Credentials used when pulling images from a private registry
+type RegistryAuth struct {
+	Registry string `json:"registry"`
+	Username string `json:"username"`
+	Password Secret `json:"password"`
+}
+
+// The credentials for registry, or nil if it needs none
+func (c GoobernetConfig) RegistryCredentials(registry string) *RegistryAuth {
+	for i := range c.RegistryAuth {
+		if c.RegistryAuth[i].Registry == registry {
+			auth := c.RegistryAuth[i]
+			return &auth
+		}
+	}
+	return nil
+}
+
+// Adds credentials for a registry, replacing any it already had
+func (c *GoobernetConfig) SetRegistryAuth(auth RegistryAuth) {
+	updated := make([]RegistryAuth, 0, len(c.RegistryAuth)+1)
+	for _, a := range c.RegistryAuth {
+		if a.Registry != auth.Registry {
+			updated = append(updated, a)
+		}
+	}
+	c.RegistryAuth = append(updated, auth)
 }
 
 type Project struct {
@@ -27,6 +57,71 @@ type Project struct {
 	ContactName   string          `json:"contactName"`
 	GithubUrl     string          `json:"githubUrl"`
 	BuildTemplate JenkinsTemplate `json:"buildTemplate"`
+	HealthCheck   HealthCheck     `json:"healthCheck"`
+}
+
+// Kinds of health check
+const (
+	// GET the path on the deployment's port, expecting 2xx or 3xx
+	HEALTH_HTTP = "http"
+	// connect to the deployment's port
+	HEALTH_TCP = "tcp"
+	// run the command in the container, expecting it to exit 0
+	HEALTH_COMMAND = "command"
+)
+
+// How the checker decides whether a project's deployments are
+// healthy. An empty Type means the project isn't checked. Zero
+// intervals, timeouts and thresholds take the defaults below.
+type HealthCheck struct {
+	Type    string   `json:"type"`
+	Path    string   `json:"path,omitempty"`
+	Command []string `json:"command,omitempty"`
+	// seconds between probes, and how long each probe may take
+	Interval uint `json:"interval,omitempty"`
+	Timeout  uint `json:"timeout,omitempty"`
+	// consecutive probes needed to change the status
+	HealthyThreshold   uint `json:"healthyThreshold,omitempty"`
+	UnhealthyThreshold uint `json:"unhealthyThreshold,omitempty"`
+}
+
+const (
+	DEFAULT_HEALTH_INTERVAL           = 30 * time.Second
+	DEFAULT_HEALTH_PROBE_TIMEOUT      = 5 * time.Second
+	DEFAULT_HEALTHY_THRESHOLD    uint = 1
+	DEFAULT_UNHEALTHY_THRESHOLD  uint = 3
+)
+
+func (h HealthCheck) Enabled() bool {
+	return h.Type != ""
+}
+
+func (h HealthCheck) IntervalDuration() time.Duration {
+	if h.Interval == 0 {
+		return DEFAULT_HEALTH_INTERVAL
+	}
+	return time.Duration(h.Interval) * time.Second
+}
+
+func (h HealthCheck) TimeoutDuration() time.Duration {
+	if h.Timeout == 0 {
+		return DEFAULT_HEALTH_PROBE_TIMEOUT
+	}
+	return time.Duration(h.Timeout) * time.Second
+}
+
+func (h HealthCheck) Healthy() uint {
+	if h.HealthyThreshold == 0 {
+		return DEFAULT_HEALTHY_THRESHOLD
+	}
+	return h.HealthyThreshold
+}
+
+func (h HealthCheck) Unhealthy() uint {
+	if h.UnhealthyThreshold == 0 {
+		return DEFAULT_UNHEALTHY_THRESHOLD
+	}
+	return h.UnhealthyThreshold
 }
 
 type ProjectList []Project
@@ -56,6 +151,20 @@ type Deployment struct {
 	Project     Project
 	Environment Environment
 	Port        uint
+	// stopped on purpose, so the reconciler leaves the container be
+	// until the next deploy or start
+	Stopped bool
+}
+
+// The address other services use to reach this deployment
+func (d Deployment) Url() string {
+	return d.Environment.Hostname + ":" + strconv.FormatUint(uint64(d.Port), 10)
+}
+
+// The image the deployment runs, pushed to the environment's registry
+// under the project's short name
+func (d Deployment) Image() string {
+	return d.Environment.Registry + "/" + d.Project.ShortName
 }
 
 // Used to serialise and deserialise deployments
@@ -63,6 +172,7 @@ type DeploymentJoin struct {
 	EnvironmentId uint `json:"environmentId"`
 	ProjectId     uint `json:"projectId"`
 	Port          uint `json:"port"`
+	Stopped       bool `json:"stopped,omitempty"`
 }
 
 type JenkinsTemplate struct {
@@ -71,252 +181,304 @@ type JenkinsTemplate struct {
 	Content     string `json:"content"`
 }
 
-var config GoobernetConfig
-var projects []Project
-var environments []Environment
-var deployments []Deployment
-var templates []JenkinsTemplate
-
-func init() {
-	_, err := os.Stat(".goobernet")
-	if err != nil {
-		fmt.Printf("Creating new config")
-		createConfigDirectory()
-	} else {
-		fmt.Printf("Loading config data\n")
-		readConfig()
-	}
+// Values handed to containers as environment variables. A ProjectId
+// of 0 holds the defaults for every project in the environment.
+type ConfigValues struct {
+	EnvironmentId uint              `json:"environmentId"`
+	ProjectId     uint              `json:"projectId"`
+	Values        map[string]string `json:"values"`
 }
 
-func GetConfig() GoobernetConfig {
-	return config
+// A record of one deploy of a project to an environment. Revisions
+// count up from 1 for each environment/project pair.
+type Revision struct {
+	Revision      uint   `json:"revision"`
+	EnvironmentId uint   `json:"environmentId"`
+	ProjectId     uint   `json:"projectId"`
+	Image         string `json:"image"`
+	Tag           string `json:"tag"`
+	Digest        string `json:"digest,omitempty"`
+	// set when the tag is a Jenkins build number
+	BuildNumber     uint64            `json:"buildNumber,omitempty"`
+	Port            uint              `json:"port"`
+	EnvironmentVars map[string]string `json:"environmentVars"`
+	TriggeredBy     string            `json:"triggeredBy"`
+	Timestamp       time.Time         `json:"timestamp"`
+	// the revision this one rolled back to, if any
+	RollbackOf uint `json:"rollbackOf,omitempty"`
 }
 
-func GetProjects() []Project {
-	return projects
-}
-
-func GetEnvironments() []Environment {
-	return environments
-}
-
-func GetEnvironmentById(id uint) (Environment, error) {
-	for i := 0; i < len(environments); i++ {
-		if environments[i].Id == id {
-			return environments[i], nil
-		}
-	}
-	return Environment{}, fmt.Errorf("Unable to find environment with id: %d", id)
-}
-
-func GetEnvironmentByName(name string) (Environment, error) {
-	name = strings.ToLower(name)
-	for i := 0; i < len(environments); i++ {
-		if strings.ToLower(environments[i].Name) == name {
-			return environments[i], nil
+// A copy with the environment variables' values masked, as config
+// values can be secrets
+func (r Revision) Redacted() Revision {
+	if r.EnvironmentVars != nil {
+		env := make(map[string]string, len(r.EnvironmentVars))
+		for k, v := range r.EnvironmentVars {
+			env[k] = Secret(v).String()
 		}
+		r.EnvironmentVars = env
 	}
-	return Environment{}, fmt.Errorf("Unable to find environment named '%s'", name)
+	return r
 }
 
-func GetDeployments() []Deployment {
-	return deployments
+// The last ids handed out, persisted so that ids aren't reused
+// after a delete
+type Sequences struct {
+	Projects     uint `json:"projects"`
+	Environments uint `json:"environments"`
 }
 
-func GetDeploymentsByEnvironmentName(environmentName string) (map[string]string, error) {
-	environment, err := GetEnvironmentByName(environmentName)
-	if err != nil {
-		return make(map[string]string), fmt.Errorf("Could not find environment with the name '%s'", environmentName)
-	}
-	return GetDeploymentsByEnvironmentId(environment.Id)
+// Store holds goobernet's state. Validation and port allocation
+// rules are the same whatever the backing storage. Lists come back
+// whole or with an error, never partially read.
+type Store interface {
+	GetConfig() (GoobernetConfig, error)
+	SaveConfig(config GoobernetConfig) error
+
+	GetProjects() ([]Project, error)
+	GetProjectById(id uint) (Project, error)
+	GetProjectByShortName(shortName string) (Project, error)
+	AddProject(newProject Project) (Project, error)
+	UpdateProject(updated Project) error
+	DeleteProject(id uint) error
+
+	GetEnvironments() ([]Environment, error)
+	GetEnvironmentById(id uint) (Environment, error)
+	GetEnvironmentByName(name string) (Environment, error)
+	AddEnvironment(newEnvironment Environment) (Environment, error)
+	UpdateEnvironment(updated Environment) error
+	DeleteEnvironment(id uint) error
+
+	GetDeployments() ([]Deployment, error)
+	GetDeployment(environmentId, projectId uint) (Deployment, error)
+	GetDeploymentsByEnvironmentName(environmentName string) (map[string]string, error)
+	GetDeploymentsByEnvironmentId(id uint) (map[string]string, error)
+	AddDeployment(environmentId, projectId uint) (Deployment, error)
+	SetDeploymentPort(environmentId, projectId, port uint) (Deployment, error)
+	SetDeploymentStopped(environmentId, projectId uint, stopped bool) error
+	DeleteDeployment(environmentId, projectId uint) error
+
+	GetTemplates() ([]JenkinsTemplate, error)
+	GetTemplateByName(templateName string) (*JenkinsTemplate, error)
+	AddTemplate(newTemplate JenkinsTemplate) error
+	UpdateTemplate(updated JenkinsTemplate) error
+	DeleteTemplate(templateName string) error
+
+	// projectId 0 refers to the environment-wide defaults
+	GetConfigValues(environmentId, projectId uint) (map[string]string, error)
+	SetConfigValues(environmentId, projectId uint, values map[string]string) error
+	DeleteConfigValues(environmentId, projectId uint) error
+
+	// oldest first
+	GetRevisions(environmentId, projectId uint) ([]Revision, error)
+	GetRevision(environmentId, projectId, revision uint) (Revision, error)
+	// numbers the revision after the last one for the pair
+	AddRevision(revision Revision) (Revision, error)
 }
 
-func GetDeploymentsByEnvironmentId(id uint) (map[string]string, error) {
-	urlMap := make(map[string]string)
+const DEFAULT_CONFIG_DIR = ".goobernet"
 
-	for i := 0; i < len(deployments); i++ {
-		d := deployments[i]
-		if d.Environment.Id == id {
-			urlMap[d.Project.ShortName] = d.Environment.Hostname + ":" + strconv.FormatUint(uint64(d.Port), 10)
-		}
+// GOOBERNET_CONFIG_DIR if set, otherwise .goobernet in the working directory
+func ConfigDir() string {
+	if dir := os.Getenv("GOOBERNET_CONFIG_DIR"); dir != "" {
+		return dir
 	}
-
-	return urlMap, nil
+	return DEFAULT_CONFIG_DIR
 }
 
-func GetTemplates() []JenkinsTemplate {
-	return templates
+// Config for a brand new config directory. This is saved, so
+// environment overrides are left for the caller to apply.
+func DefaultConfig() GoobernetConfig {
+	return GoobernetConfig{
+		JenkinsUrl: "http://localhost:8080",
+		Registry:   "localhost:5000",
+	}
 }
 
-func GetTemplateByName(templateName string) (*JenkinsTemplate, error) {
-	for _, template := range templates {
-		if template.Name == templateName {
-			return &template, nil
+// Returns a copy of the config with any GOOBERNET_* environment
+// variables taking precedence. Overrides are never saved.
+func (c GoobernetConfig) WithEnvOverrides() GoobernetConfig {
+	overrides := []struct {
+		name  string
+		field *string
+	}{
+		{"GOOBERNET_JENKINS_URL", &c.JenkinsUrl},
+		{"GOOBERNET_JENKINS_USERNAME", &c.JenkinsUsername},
+		{"GOOBERNET_JENKINS_PASSWORD", (*string)(&c.JenkinsPassword)},
+		{"GOOBERNET_REGISTRY", &c.Registry},
+	}
+	for _, o := range overrides {
+		if value, ok := os.LookupEnv(o.name); ok {
+			*o.field = value
 		}
 	}
-	return nil, errors.New(fmt.Sprintf("Could not find template '%s'", templateName))
-}
-
-func AddProject(newProject Project) error {
-	newProjects := append(projects, newProject)
-	sort.Sort(ProjectList(newProjects))
-	projects = newProjects
-	return serialise(projects, "projects.json")
+	return c
 }
 
-/* --------------------------------------------------*/
-
-// Serialisation methods
-
-// And yes, this is serialising to config files on the File System
-// Is this really a problem, though?
-
-func createConfigDirectory() {
-	// create directory
-	os.Mkdir(".goobernet", 0755)
-
-	c := GoobernetConfig{"https://docker-server.dev.etd.nicta.com.au", "username", "password", "etd-docker.research.nicta.com.au"}
-	if err := serialise(config, "config.json"); err != nil {
-		return
+// Checks the fields we rely on when creating jobs and deployments
+func ValidateProject(project Project) error {
+	if strings.TrimSpace(project.Name) == "" {
+		return errors.New("Project name is required")
 	}
-	config = c
-
-	projects = make([]Project, 0, 5)
-	if err := serialise(projects, "projects.json"); err != nil {
-		return
+	if strings.TrimSpace(project.ShortName) == "" {
+		return errors.New("Project short name is required")
 	}
-
-	environments = make([]Environment, 0, 5)
-	if err := serialise(environments, "environments.json"); err != nil {
-		return
+	if strings.ContainsAny(project.ShortName, " /:") {
+		return fmt.Errorf("Project short name '%s' may not contain spaces, slashes or colons", project.ShortName)
 	}
+	return ValidateHealthCheck(project.HealthCheck)
+}
 
-	deployments = make([]Deployment, 0, 5)
-	if err := serialise(deployments, "deployments.json"); err != nil {
-		return
+func ValidateHealthCheck(check HealthCheck) error {
+	switch check.Type {
+	case "":
+		return nil
+	case HEALTH_HTTP:
+		if !strings.HasPrefix(check.Path, "/") {
+			return fmt.Errorf("Health check path '%s' must start with a slash", check.Path)
+		}
+	case HEALTH_TCP:
+	case HEALTH_COMMAND:
+		if len(check.Command) == 0 {
+			return errors.New("Command health checks need a command")
+		}
+	default:
+		return fmt.Errorf("Unknown health check type '%s', expected %s, %s or %s", check.Type, HEALTH_HTTP, HEALTH_TCP, HEALTH_COMMAND)
 	}
-
-	templates = make([]JenkinsTemplate, 0, 5)
-	if err := serialise(templates, "templates.json"); err != nil {
-		return
+	if check.Timeout > 0 && check.Interval > 0 && check.Timeout > check.Interval {
+		return fmt.Errorf("Health check timeout %ds is longer than its interval %ds", check.Timeout, check.Interval)
 	}
+	return nil
 }
 
-func serialise(obj interface{}, filename string) error {
-	bytes, err := PrettyPrint(obj)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error serialising object: %s\n", err.Error())
+// Checks that an environment can be used for deployments and discovery
+func ValidateEnvironment(environment Environment) error {
+	if strings.TrimSpace(environment.Name) == "" {
+		return errors.New("Environment name is required")
+	}
+	if err := validateHost("hostname", environment.Hostname); err != nil {
 		return err
 	}
-
-	err = ioutil.WriteFile(".goobernet/"+filename, bytes, 0644)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error writing file: %s\n", err.Error())
+	if environment.StartingPort == 0 || environment.StartingPort > 65535 {
+		return fmt.Errorf("Starting port %d is outside the range 1-65535", environment.StartingPort)
+	}
+	if err := validateHost("registry", environment.Registry); err != nil {
 		return err
 	}
-
 	return nil
 }
 
-func readConfig() {
-	bytes, err := ioutil.ReadFile(".goobernet/config.json")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading config: %s\n", err.Error())
-	} else {
-		err = json.Unmarshal(bytes, &config)
+// hostnames are joined with ports and image names, so they must be bare
+func validateHost(field, host string) error {
+	if strings.TrimSpace(host) == "" {
+		return fmt.Errorf("Environment %s is required", field)
 	}
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error unmarshalling config json: %s\n", err.Error())
+	if strings.Contains(host, "://") {
+		return fmt.Errorf("Environment %s '%s' should not include a scheme", field, host)
 	}
-
-	bytes, err = ioutil.ReadFile(".goobernet/projects.json")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading project data: %s\n", err.Error())
-	} else {
-		err = json.Unmarshal(bytes, &projects)
-	}
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error unmarshalling project json: %s\n", err.Error())
+	if strings.ContainsAny(host, " \t/") {
+		return fmt.Errorf("Environment %s '%s' may not contain spaces or slashes", field, host)
 	}
+	return nil
+}
 
-	bytes, err = ioutil.ReadFile(".goobernet/environments.json")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading environment data: %s\n", err.Error())
-	} else {
-		err = json.Unmarshal(bytes, &environments)
+func ValidateTemplate(template JenkinsTemplate) error {
+	if strings.TrimSpace(template.Name) == "" {
+		return errors.New("Template name is required")
 	}
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error unmarshalling environment json: %s\n", err.Error())
+	if strings.Contains(template.Name, "/") {
+		return fmt.Errorf("Template name '%s' may not contain slashes", template.Name)
 	}
-
-	bytes, err = ioutil.ReadFile(".goobernet/templates.json")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading template data: %s\n", err.Error())
-	} else {
-		err = json.Unmarshal(bytes, &templates)
+	if strings.TrimSpace(template.Content) == "" {
+		return fmt.Errorf("Template '%s' has no content", template.Name)
 	}
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error unmarshalling template json: %s\n", err.Error())
+	return nil
+}
+
+var envVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func ValidateConfigValues(values map[string]string) error {
+	for name := range values {
+		if !envVarName.MatchString(name) {
+			return fmt.Errorf("'%s' is not a valid environment variable name", name)
+		}
 	}
+	return nil
+}
 
-	// deployment joins refer to ids
-	// but in memory we'll store actual objects
-	var djs []DeploymentJoin
-	bytes, err = ioutil.ReadFile(".goobernet/deployments.json")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading deployment data: %s\n", err.Error())
-	} else {
-		err = json.Unmarshal(bytes, &djs)
+// Ids of 0 are assigned the next value in the sequence. Any other
+// id is kept as long as nothing already has it.
+func assignId(requested uint, seq *uint, taken func(id uint) bool) (uint, error) {
+	if requested == 0 {
+		*seq++
+		for taken(*seq) {
+			*seq++
+		}
+		return *seq, nil
 	}
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error unmarshalling deployment json: %s\n", err.Error())
+	if taken(requested) {
+		return 0, fmt.Errorf("Id %d is already in use", requested)
 	}
+	if requested > *seq {
+		*seq = requested
+	}
+	return requested, nil
+}
 
-	var depls = make([]Deployment, 0, 10)
-	for i := 0; i < len(djs); i++ {
-		join := djs[i]
+// The port a new deployment to environment would get. Ports are bound
+// on the host, so any environment sharing the hostname competes for
+// the same range.
+func NextFreePort(environment Environment, deployments []Deployment) (uint, error) {
+	used := make(map[uint]bool)
+	for i := 0; i < len(deployments); i++ {
+		d := deployments[i]
+		if d.Environment.Hostname == environment.Hostname {
+			used[d.Port] = true
+		}
+	}
 
-		// assume few projects/deployments, so looping is cheap
-		var proj Project
-		for j := 0; j < len(projects); j++ {
-			if projects[j].Id == join.ProjectId {
-				proj = projects[j]
-				break
-			}
+	for port := environment.StartingPort; port <= 65535; port++ {
+		if !used[port] {
+			return port, nil
 		}
-		if proj.Id == 0 {
-			fmt.Fprintf(os.Stderr, "Project id %d not found during initialisation\n", join.ProjectId)
+	}
+	return 0, fmt.Errorf("No free ports left in environment '%s' from %d", environment.Name, environment.StartingPort)
+}
+
+// Checks that no other deployment on d's host holds port
+func checkPortFree(d Deployment, deployments []Deployment, port uint) error {
+	if port == 0 || port > 65535 {
+		return fmt.Errorf("Port %d is outside the range 1-65535", port)
+	}
+	for _, other := range deployments {
+		if other.Environment.Hostname != d.Environment.Hostname || other.Port != port {
 			continue
 		}
-		var env Environment
-		for j := 0; j < len(environments); j++ {
-			if environments[j].Id == join.EnvironmentId {
-				env = environments[j]
-				break
-			}
+		if other.Environment.Id != d.Environment.Id || other.Project.Id != d.Project.Id {
+			return fmt.Errorf("Port %d on %s is already used by '%s' in '%s'", port, other.Environment.Hostname, other.Project.ShortName, other.Environment.Name)
 		}
-		if env.Id == 0 {
-			fmt.Fprintf(os.Stderr, "Environment id %d not found during initialisation\n", join.EnvironmentId)
-			continue
+	}
+	return nil
+}
+
+// The first of deployments that match does, if any
+func findDeployment(deployments []Deployment, match func(d Deployment) bool) (Deployment, bool) {
+	for _, d := range deployments {
+		if match(d) {
+			return d, true
 		}
-		depls = append(depls, Deployment{proj, env, join.Port})
 	}
+	return Deployment{}, false
+}
 
-	deployments = depls
+// Containers are found by environment name and project short name, so
+// neither can change while the project is deployed
+func projectRenameError(existing Project, d Deployment) error {
+	return fmt.Errorf("Project '%s' can't be renamed while it's deployed to environment '%s'", existing.ShortName, d.Environment.Name)
 }
 
-func deserialise(obj interface{}, filename string) (interface{}, error) {
-	bytes, err := ioutil.ReadFile(".goobernet/" + filename)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", filename, err.Error())
-		return nil, err
-	}
-	err = json.Unmarshal(bytes, &obj)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error unmarshalling json: %s\n", err.Error())
-		return nil, err
-	}
-	return obj, nil
+func environmentRenameError(existing Environment, d Deployment) error {
+	return fmt.Errorf("Environment '%s' can't be renamed while it has a deployment of '%s'", existing.Name, d.Project.ShortName)
 }
 
 func PrettyPrint(obj interface{}) ([]byte, error) {
@@ -0,0 +1,66 @@
+package data
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Works out the environment variables for a deployment's container.
+// Service variables for the other deployments in the environment come
+// first, then the environment's defaults, then the project's own values.
+func EnvironmentVars(store Store, d Deployment) (map[string]string, error) {
+	vars, err := ServiceVars(store, d)
+	if err != nil {
+		return nil, err
+	}
+	for _, projectId := range []uint{0, d.Project.Id} {
+		values, err := store.GetConfigValues(d.Environment.Id, projectId)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range values {
+			vars[k] = v
+		}
+	}
+	return vars, nil
+}
+
+// Kubernetes-style <SHORTNAME>_SERVICE_HOST and <SHORTNAME>_SERVICE_PORT
+// variables for every other project deployed to d's environment
+func ServiceVars(store Store, d Deployment) (map[string]string, error) {
+	urls, err := store.GetDeploymentsByEnvironmentId(d.Environment.Id)
+	if err != nil {
+		return nil, err
+	}
+	return ServiceVarsFromUrls(urls, d.Project.ShortName)
+}
+
+// The service variables for the project called shortName, given the
+// urls of its environment's deployments keyed by short name
+func ServiceVarsFromUrls(urls map[string]string, shortName string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for other, url := range urls {
+		if other == shortName {
+			continue
+		}
+		host, port, err := net.SplitHostPort(url)
+		if err != nil {
+			return nil, fmt.Errorf("Deployment of '%s' has an invalid url '%s': %s", other, url, err.Error())
+		}
+		prefix := serviceVarPrefix(other)
+		vars[prefix+"_SERVICE_HOST"] = host
+		vars[prefix+"_SERVICE_PORT"] = port
+	}
+	return vars, nil
+}
+
+// Whether name is one of the service variables ServiceVars makes
+func IsServiceVar(name string) bool {
+	return strings.HasSuffix(name, "_SERVICE_HOST") || strings.HasSuffix(name, "_SERVICE_PORT")
+}
+
+// Same as Kubernetes: upper case, with dashes and dots as underscores
+func serviceVarPrefix(shortName string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(shortName))
+}
@@ -0,0 +1,353 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// And yes, this is serialising to config files on the File System
+// Is this really a problem, though?
+
+// config.json holds secrets as stored (i.e. encrypted), so it can't
+// go through GoobernetConfig's redacting marshaller
+type configFile struct {
+	JenkinsUrl      string             `json:"jenkinsUrl"`
+	JenkinsUsername string             `json:"jenkinsUsername"`
+	JenkinsPassword string             `json:"jenkinsPassword"`
+	Registry        string             `string:"registry"`
+	RegistryAuth    []registryAuthFile `json:"registryAuth,omitempty"`
+}
+
+type registryAuthFile struct {
+	Registry string `json:"registry"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func newConfigFile(c GoobernetConfig) configFile {
+	cf := configFile{
+		JenkinsUrl:      c.JenkinsUrl,
+		JenkinsUsername: c.JenkinsUsername,
+		JenkinsPassword: c.JenkinsPassword.Reveal(),
+		Registry:        c.Registry,
+	}
+	for _, a := range c.RegistryAuth {
+		cf.RegistryAuth = append(cf.RegistryAuth, registryAuthFile{a.Registry, a.Username, a.Password.Reveal()})
+	}
+	return cf
+}
+
+func (cf configFile) config() GoobernetConfig {
+	c := GoobernetConfig{
+		JenkinsUrl:      cf.JenkinsUrl,
+		JenkinsUsername: cf.JenkinsUsername,
+		JenkinsPassword: Secret(cf.JenkinsPassword),
+		Registry:        cf.Registry,
+	}
+	for _, a := range cf.RegistryAuth {
+		c.RegistryAuth = append(c.RegistryAuth, RegistryAuth{a.Registry, a.Username, Secret(a.Password)})
+	}
+	return c
+}
+
+// Keeps state in memory and writes the changed file back to the
+// config directory after every change
+type JsonStore struct {
+	*MemoryStore
+	dir      string
+	readOnly bool
+	// deployments of projects or environments that aren't there, kept
+	// so that writing deployments.json doesn't lose them
+	unresolved []DeploymentJoin
+}
+
+// Opens the JSON file store in dir, creating it with default config
+// if it doesn't exist yet
+func Open(dir string) (*JsonStore, error) {
+	store := newJsonStore(dir, false)
+
+	_, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		fmt.Printf("Creating new config in %s\n", dir)
+		return store, store.createConfigDirectory()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Loading config data from %s\n", dir)
+	if err := store.readConfig(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Opens the existing JSON file store in dir without writing to it.
+// Ids assigned to older config are only kept in memory, and any
+// change fails.
+func OpenReadOnly(dir string) (*JsonStore, error) {
+	store := newJsonStore(dir, true)
+	if err := store.readConfig(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func newJsonStore(dir string, readOnly bool) *JsonStore {
+	store := &JsonStore{
+		MemoryStore: NewMemoryStore(GoobernetConfig{}),
+		dir:         dir,
+		readOnly:    readOnly,
+	}
+	store.changed = store.write
+	return store
+}
+
+// Problems found opening the store that didn't stop it opening
+func (s *JsonStore) Warnings() []string {
+	warnings := make([]string, 0, len(s.unresolved))
+	for _, join := range s.unresolved {
+		warnings = append(warnings, fmt.Sprintf("deployments.json has a deployment of project id %d to environment id %d, one of which doesn't exist; it's ignored but kept",
+			join.ProjectId, join.EnvironmentId))
+	}
+	return warnings
+}
+
+func (s *JsonStore) write(kind string) error {
+	if s.readOnly {
+		return fmt.Errorf("Config in %s is open read only", s.dir)
+	}
+	switch kind {
+	case CONFIG:
+		return s.serialise(newConfigFile(s.config), "config.json")
+	case PROJECTS:
+		// sequences go first, so a crash can only ever skip an id
+		if err := s.write(SEQUENCES); err != nil {
+			return err
+		}
+		return s.serialise(s.projects, "projects.json")
+	case ENVIRONMENTS:
+		if err := s.write(SEQUENCES); err != nil {
+			return err
+		}
+		return s.serialise(s.environments, "environments.json")
+	case SEQUENCES:
+		return s.serialise(s.sequences, "sequences.json")
+	case DEPLOYMENTS:
+		return s.serialiseDeployments()
+	case TEMPLATES:
+		return s.serialise(s.templates, "templates.json")
+	case VALUES:
+		return s.serialise(s.configValues, "config-values.json")
+	case REVISIONS:
+		return s.serialise(s.revisions, "revisions.json")
+	}
+	return fmt.Errorf("Unknown kind of data: %s", kind)
+}
+
+func (s *JsonStore) createConfigDirectory() error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	s.config = DefaultConfig()
+
+	for _, kind := range []string{CONFIG, SEQUENCES, PROJECTS, ENVIRONMENTS, DEPLOYMENTS, TEMPLATES, VALUES, REVISIONS} {
+		if err := s.write(kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *JsonStore) serialise(obj interface{}, filename string) error {
+	bytes, err := PrettyPrint(obj)
+	if err != nil {
+		return fmt.Errorf("Error serialising %s: %s", filename, err.Error())
+	}
+
+	err = writeFileAtomic(filepath.Join(s.dir, filename), bytes, 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing %s: %s", filename, err.Error())
+	}
+
+	return nil
+}
+
+// Writes to a temp file alongside the target and renames it into
+// place, so a crash mid-write leaves the previous file intact
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, filename)
+}
+
+// deployments are stored as id joins rather than full objects
+func (s *JsonStore) serialiseDeployments() error {
+	djs := make([]DeploymentJoin, 0, len(s.deployments))
+	for i := 0; i < len(s.deployments); i++ {
+		d := s.deployments[i]
+		djs = append(djs, DeploymentJoin{d.Environment.Id, d.Project.Id, d.Port, d.Stopped})
+	}
+	djs = append(djs, s.unresolved...)
+	return s.serialise(djs, "deployments.json")
+}
+
+func (s *JsonStore) deserialise(obj interface{}, filename string) error {
+	bytes, err := ioutil.ReadFile(filepath.Join(s.dir, filename))
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %s", filename, err.Error())
+	}
+	err = json.Unmarshal(bytes, obj)
+	if err != nil {
+		return fmt.Errorf("Error unmarshalling %s: %s", filename, err.Error())
+	}
+	return nil
+}
+
+func (s *JsonStore) readConfig() error {
+	var cf configFile
+	files := []struct {
+		obj      interface{}
+		filename string
+	}{
+		{&cf, "config.json"},
+		{&s.projects, "projects.json"},
+		{&s.environments, "environments.json"},
+		{&s.templates, "templates.json"},
+	}
+	for _, f := range files {
+		if err := s.deserialise(f.obj, f.filename); err != nil {
+			return err
+		}
+	}
+	s.config = cf.config()
+
+	// added after the other files, so may not exist yet
+	optional := []struct {
+		obj      interface{}
+		filename string
+	}{
+		{&s.configValues, "config-values.json"},
+		{&s.revisions, "revisions.json"},
+	}
+	for _, f := range optional {
+		if _, err := os.Stat(filepath.Join(s.dir, f.filename)); err == nil {
+			if err := s.deserialise(f.obj, f.filename); err != nil {
+				return err
+			}
+		}
+	}
+
+	// deployment joins refer to ids
+	// but in memory we'll store actual objects
+	var djs []DeploymentJoin
+	if err := s.deserialise(&djs, "deployments.json"); err != nil {
+		return err
+	}
+
+	if err := s.readSequences(djs); err != nil {
+		return err
+	}
+
+	var depls = make([]Deployment, 0, 10)
+	for i := 0; i < len(djs); i++ {
+		join := djs[i]
+
+		// assume few projects/deployments, so looping is cheap
+		// older directories can have joins to projects or environments
+		// that had no id, and have since been given one
+		proj, projErr := s.projectById(join.ProjectId)
+		env, envErr := s.environmentById(join.EnvironmentId)
+		if projErr != nil || envErr != nil {
+			s.unresolved = append(s.unresolved, join)
+			continue
+		}
+		depls = append(depls, Deployment{proj, env, join.Port, join.Stopped})
+	}
+
+	s.deployments = depls
+	return nil
+}
+
+// Older config directories have no sequences file, and may have
+// projects or environments with no id at all. Ids the deployments
+// refer to are never handed out again, even if what had them is gone,
+// or the deployment would pick up whatever was given them.
+func (s *JsonStore) readSequences(djs []DeploymentJoin) error {
+	if _, err := os.Stat(filepath.Join(s.dir, "sequences.json")); err == nil {
+		if err := s.deserialise(&s.sequences, "sequences.json"); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range s.projects {
+		if p.Id > s.sequences.Projects {
+			s.sequences.Projects = p.Id
+		}
+	}
+	for _, e := range s.environments {
+		if e.Id > s.sequences.Environments {
+			s.sequences.Environments = e.Id
+		}
+	}
+	for _, join := range djs {
+		if join.ProjectId > s.sequences.Projects {
+			s.sequences.Projects = join.ProjectId
+		}
+		if join.EnvironmentId > s.sequences.Environments {
+			s.sequences.Environments = join.EnvironmentId
+		}
+	}
+
+	fixed := false
+	for i := range s.projects {
+		if s.projects[i].Id == 0 {
+			s.sequences.Projects++
+			s.projects[i].Id = s.sequences.Projects
+			fmt.Printf("Assigned id %d to project '%s'\n", s.projects[i].Id, s.projects[i].ShortName)
+			fixed = true
+		}
+	}
+	for i := range s.environments {
+		if s.environments[i].Id == 0 {
+			s.sequences.Environments++
+			s.environments[i].Id = s.sequences.Environments
+			fmt.Printf("Assigned id %d to environment '%s'\n", s.environments[i].Id, s.environments[i].Name)
+			fixed = true
+		}
+	}
+
+	if fixed && !s.readOnly {
+		if err := s.write(PROJECTS); err != nil {
+			return err
+		}
+		return s.write(ENVIRONMENTS)
+	}
+	return nil
+}
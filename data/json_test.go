@@ -0,0 +1,205 @@
+package data
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Reads every file in dir, so a test can check nothing was written
+func readDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	contents := map[string]string{}
+	for _, f := range files {
+		bytes, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			t.Fatalf("ReadFile: %s", err)
+		}
+		contents[f.Name()] = string(bytes)
+	}
+	return contents
+}
+
+func TestJsonStoreOpenReadOnly(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "config")
+	if _, err := OpenReadOnly(dir); err == nil {
+		t.Errorf("OpenReadOnly of a missing directory succeeded")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("OpenReadOnly created %s", dir)
+	}
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	mustAddProject(t, s, "billing")
+
+	// an older directory: no sequences file, and a project with no id,
+	// which opening fixes
+	projects, _ := s.GetProjects()
+	projects[0].Id = 0
+	bytes, err := json.Marshal(projects)
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "projects.json"), bytes, 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if err := os.Remove(filepath.Join(dir, "sequences.json")); err != nil {
+		t.Fatalf("Remove: %s", err)
+	}
+	before := readDir(t, dir)
+
+	ro, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatalf("OpenReadOnly: %s", err)
+	}
+	if got, _ := ro.GetProjects(); len(got) != 1 || got[0].Id != 1 {
+		t.Errorf("GetProjects = %+v, want billing given id 1", got)
+	}
+	if _, err := ro.AddProject(Project{Name: "ledger", ShortName: "ledger"}); err == nil {
+		t.Errorf("AddProject on a read only store succeeded")
+	}
+	if got, _ := ro.GetProjects(); len(got) != 1 {
+		t.Errorf("%d projects after a refused change, want 1", len(got))
+	}
+	if after := readDir(t, dir); !reflect.DeepEqual(after, before) {
+		t.Errorf("OpenReadOnly changed the config directory:\n%v\nwant\n%v", after, before)
+	}
+}
+
+func TestJsonStoreKeepsUnresolvedDeployments(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "config")
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	e := mustAddEnvironment(t, s, "dev", "localhost", 8000)
+	mustAddDeployment(t, s, e, mustAddProject(t, s, "billing"))
+
+	// a deployment of a project that isn't in projects.json
+	var djs []DeploymentJoin
+	if err := s.deserialise(&djs, "deployments.json"); err != nil {
+		t.Fatalf("reading deployments: %s", err)
+	}
+	dangling := DeploymentJoin{EnvironmentId: e.Id, ProjectId: 9, Port: 8009}
+	if err := s.serialise(append(djs, dangling), "deployments.json"); err != nil {
+		t.Fatalf("writing deployments: %s", err)
+	}
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopening: %s", err)
+	}
+	if warnings := s.Warnings(); len(warnings) != 1 {
+		t.Errorf("Warnings = %v, want the dangling deployment", warnings)
+	}
+	if got, _ := s.GetDeployments(); len(got) != 1 {
+		t.Errorf("%d deployments, want only billing's", len(got))
+	}
+
+	// its project id isn't reused, and writing deployments keeps it
+	p := mustAddProject(t, s, "ledger")
+	if p.Id != dangling.ProjectId+1 {
+		t.Errorf("new project id = %d, want %d", p.Id, dangling.ProjectId+1)
+	}
+	mustAddDeployment(t, s, e, p)
+	djs = nil
+	if err := s.deserialise(&djs, "deployments.json"); err != nil {
+		t.Fatalf("reading deployments: %s", err)
+	}
+	kept := false
+	for _, join := range djs {
+		kept = kept || join == dangling
+	}
+	if len(djs) != 3 || !kept {
+		t.Errorf("deployments.json = %+v, want both deployments and the dangling one", djs)
+	}
+}
+
+// Puts a directory where the store writes name, so writing it fails
+// until the returned func takes it away again
+func blockFile(t *testing.T, s *JsonStore, name string) func() {
+	t.Helper()
+	path := filepath.Join(s.dir, name)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		t.Fatalf("Remove: %s", err)
+	}
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatalf("Mkdir: %s", err)
+	}
+	return func() {
+		if err := os.Remove(path); err != nil {
+			t.Fatalf("Remove: %s", err)
+		}
+	}
+}
+
+func TestJsonStoreKeepsMemoryInStepWithFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "config")
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	mustAddProject(t, s, "a")
+
+	// a directory in the way makes the next write fail
+	unblock := blockFile(t, s, "projects.json")
+	if _, err := s.AddProject(Project{Name: "b", ShortName: "b"}); err == nil {
+		t.Fatalf("AddProject succeeded with projects.json a directory")
+	}
+	if got, _ := s.GetProjects(); len(got) != 1 {
+		t.Errorf("%d projects after a failed write, want the change undone leaving 1", len(got))
+	}
+
+	unblock()
+	if p := mustAddProject(t, s, "b"); p.Id != 2 {
+		t.Errorf("id after a failed write = %d, want 2", p.Id)
+	}
+}
+
+func TestJsonStoreDeletesWholeOrNotAtAll(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "config")
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	e := mustAddEnvironment(t, s, "dev", "localhost", 8000)
+	p := mustAddProject(t, s, "billing")
+	values := map[string]string{"DB_HOST": "db"}
+	if err := s.SetConfigValues(e.Id, p.Id, values); err != nil {
+		t.Fatalf("SetConfigValues: %s", err)
+	}
+
+	// projects.json is written, then the project's values can't be
+	unblock := blockFile(t, s, "config-values.json")
+	if err := s.DeleteProject(p.Id); err == nil {
+		t.Fatalf("DeleteProject succeeded with config-values.json a directory")
+	}
+	unblock()
+	if err := s.serialise(s.configValues, "config-values.json"); err != nil {
+		t.Fatalf("putting config-values.json back: %s", err)
+	}
+
+	// both in memory and on disk, the project is still there
+	reopened, err := Open(dir)
+	if err != nil {
+		t.Fatalf("reopening: %s", err)
+	}
+	for name, store := range map[string]Store{"memory": s, "files": reopened} {
+		if _, err := store.GetProjectById(p.Id); err != nil {
+			t.Errorf("%s: project gone after a failed delete: %s", name, err)
+		}
+		if got, _ := store.GetConfigValues(e.Id, p.Id); !reflect.DeepEqual(got, values) {
+			t.Errorf("%s: config values after a failed delete = %v, want %v", name, got, values)
+		}
+	}
+}
@@ -0,0 +1,792 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Keeps everything in memory. Used directly in tests, and as the
+// cache behind the JSON file store.
+//
+// Safe for concurrent use: reads share the lock and get copies, so
+// callers can't see (or cause) changes made after the read.
+type MemoryStore struct {
+	mu           sync.RWMutex
+	config       GoobernetConfig
+	projects     []Project
+	environments []Environment
+	deployments  []Deployment
+	templates    []JenkinsTemplate
+	configValues []ConfigValues
+	revisions    []Revision
+	sequences    Sequences
+
+	// called with the kind of data after every successful change,
+	// while the write lock is still held. The change is undone if
+	// this returns an error.
+	changed func(kind string) error
+}
+
+// kinds of data passed to MemoryStore.changed
+const (
+	CONFIG       = "config"
+	PROJECTS     = "projects"
+	ENVIRONMENTS = "environments"
+	DEPLOYMENTS  = "deployments"
+	TEMPLATES    = "templates"
+	SEQUENCES    = "sequences"
+	VALUES       = "values"
+	REVISIONS    = "revisions"
+)
+
+func NewMemoryStore(config GoobernetConfig) *MemoryStore {
+	return &MemoryStore{
+		config:       config,
+		projects:     make([]Project, 0, 5),
+		environments: make([]Environment, 0, 5),
+		deployments:  make([]Deployment, 0, 5),
+		templates:    make([]JenkinsTemplate, 0, 5),
+		configValues: make([]ConfigValues, 0, 5),
+		revisions:    make([]Revision, 0, 5),
+	}
+}
+
+func (s *MemoryStore) notify(kind string) error {
+	if s.changed == nil {
+		return nil
+	}
+	return s.changed(kind)
+}
+
+// Everything a change can touch. Changes replace slices rather than
+// modifying them, so holding on to the old ones is enough to undo one.
+type memoryState struct {
+	config       GoobernetConfig
+	projects     []Project
+	environments []Environment
+	deployments  []Deployment
+	templates    []JenkinsTemplate
+	configValues []ConfigValues
+	revisions    []Revision
+	sequences    Sequences
+}
+
+func (s *MemoryStore) state() memoryState {
+	return memoryState{s.config, s.projects, s.environments, s.deployments, s.templates, s.configValues, s.revisions, s.sequences}
+}
+
+// Passes on a change, putting the store back as it was before if it
+// can't be saved, so memory doesn't hold changes that would be lost
+// on restart. A change to several kinds of data is saved whole or not
+// at all: if one kind fails, the kinds already saved are saved again
+// as they were.
+func (s *MemoryStore) save(before memoryState, kinds ...string) error {
+	for i, kind := range kinds {
+		err := s.notify(kind)
+		if err == nil {
+			continue
+		}
+		s.config, s.projects, s.environments, s.deployments = before.config, before.projects, before.environments, before.deployments
+		s.templates, s.configValues, s.revisions, s.sequences = before.templates, before.configValues, before.revisions, before.sequences
+		for _, saved := range kinds[:i] {
+			if undoErr := s.notify(saved); undoErr != nil {
+				err = fmt.Errorf("%s (and the %s saved before it couldn't be put back: %s)", err.Error(), saved, undoErr.Error())
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetConfig() (GoobernetConfig, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config, nil
+}
+
+func (s *MemoryStore) SaveConfig(config GoobernetConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.state()
+	s.config = config
+	return s.save(before, CONFIG)
+}
+
+func (s *MemoryStore) GetProjects() ([]Project, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	projects := make([]Project, len(s.projects))
+	copy(projects, s.projects)
+	return projects, nil
+}
+
+func (s *MemoryStore) GetProjectById(id uint) (Project, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.projectById(id)
+}
+
+func (s *MemoryStore) projectById(id uint) (Project, error) {
+	for i := 0; i < len(s.projects); i++ {
+		if s.projects[i].Id == id {
+			return s.projects[i], nil
+		}
+	}
+	return Project{}, fmt.Errorf("Unable to find project with id: %d", id)
+}
+
+func (s *MemoryStore) GetProjectByShortName(shortName string) (Project, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.projectByShortName(shortName)
+}
+
+func (s *MemoryStore) projectByShortName(shortName string) (Project, error) {
+	shortName = strings.ToLower(shortName)
+	for i := 0; i < len(s.projects); i++ {
+		if strings.ToLower(s.projects[i].ShortName) == shortName {
+			return s.projects[i], nil
+		}
+	}
+	return Project{}, fmt.Errorf("Unable to find project with short name '%s'", shortName)
+}
+
+// Assigns the project an id unless it already has one
+func (s *MemoryStore) AddProject(newProject Project) (Project, error) {
+	if err := ValidateProject(newProject); err != nil {
+		return Project{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.state()
+	if existing, err := s.projectByShortName(newProject.ShortName); err == nil {
+		return Project{}, fmt.Errorf("Project with short name '%s' already exists with id: %d", existing.ShortName, existing.Id)
+	}
+
+	id, err := assignId(newProject.Id, &s.sequences.Projects, func(id uint) bool {
+		_, err := s.projectById(id)
+		return err == nil
+	})
+	if err != nil {
+		return Project{}, err
+	}
+	newProject.Id = id
+
+	newProjects := make([]Project, len(s.projects), len(s.projects)+1)
+	copy(newProjects, s.projects)
+	newProjects = append(newProjects, newProject)
+	sort.Sort(ProjectList(newProjects))
+	s.projects = newProjects
+	return newProject, s.save(before, PROJECTS)
+}
+
+func (s *MemoryStore) UpdateProject(updated Project) error {
+	if err := ValidateProject(updated); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.state()
+	if existing, err := s.projectByShortName(updated.ShortName); err == nil && existing.Id != updated.Id {
+		return fmt.Errorf("Project with short name '%s' already exists with id: %d", existing.ShortName, existing.Id)
+	}
+
+	newProjects := make([]Project, len(s.projects))
+	copy(newProjects, s.projects)
+
+	found := false
+	for i := 0; i < len(newProjects); i++ {
+		if newProjects[i].Id == updated.Id {
+			if newProjects[i].ShortName != updated.ShortName {
+				if d, ok := findDeployment(s.deployments, func(d Deployment) bool { return d.Project.Id == updated.Id }); ok {
+					return projectRenameError(newProjects[i], d)
+				}
+			}
+			newProjects[i] = updated
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("Unable to find project with id: %d", updated.Id)
+	}
+
+	sort.Sort(ProjectList(newProjects))
+	s.projects = newProjects
+
+	// deployments hold copies of their project, so keep them in step
+	newDeployments := make([]Deployment, len(s.deployments))
+	copy(newDeployments, s.deployments)
+	for i := 0; i < len(newDeployments); i++ {
+		if newDeployments[i].Project.Id == updated.Id {
+			newDeployments[i].Project = updated
+		}
+	}
+	s.deployments = newDeployments
+
+	return s.save(before, PROJECTS)
+}
+
+func (s *MemoryStore) DeleteProject(id uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.state()
+	for i := 0; i < len(s.deployments); i++ {
+		if s.deployments[i].Project.Id == id {
+			return fmt.Errorf("Project %d is still deployed to environment '%s'", id, s.deployments[i].Environment.Name)
+		}
+	}
+
+	newProjects := make([]Project, 0, len(s.projects))
+	for i := 0; i < len(s.projects); i++ {
+		if s.projects[i].Id != id {
+			newProjects = append(newProjects, s.projects[i])
+		}
+	}
+	if len(newProjects) == len(s.projects) {
+		return fmt.Errorf("Unable to find project with id: %d", id)
+	}
+
+	// its config values and history go with it
+	s.projects = newProjects
+	kinds := []string{PROJECTS}
+	if s.removeConfigValues(func(cv ConfigValues) bool { return cv.ProjectId == id }) {
+		kinds = append(kinds, VALUES)
+	}
+	if s.removeRevisions(func(r Revision) bool { return r.ProjectId == id }) {
+		kinds = append(kinds, REVISIONS)
+	}
+	return s.save(before, kinds...)
+}
+
+func (s *MemoryStore) GetEnvironments() ([]Environment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	environments := make([]Environment, len(s.environments))
+	copy(environments, s.environments)
+	return environments, nil
+}
+
+func (s *MemoryStore) GetEnvironmentById(id uint) (Environment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.environmentById(id)
+}
+
+func (s *MemoryStore) environmentById(id uint) (Environment, error) {
+	for i := 0; i < len(s.environments); i++ {
+		if s.environments[i].Id == id {
+			return s.environments[i], nil
+		}
+	}
+	return Environment{}, fmt.Errorf("Unable to find environment with id: %d", id)
+}
+
+func (s *MemoryStore) GetEnvironmentByName(name string) (Environment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.environmentByName(name)
+}
+
+func (s *MemoryStore) environmentByName(name string) (Environment, error) {
+	name = strings.ToLower(name)
+	for i := 0; i < len(s.environments); i++ {
+		if strings.ToLower(s.environments[i].Name) == name {
+			return s.environments[i], nil
+		}
+	}
+	return Environment{}, fmt.Errorf("Unable to find environment named '%s'", name)
+}
+
+// Assigns the environment an id unless it already has one
+func (s *MemoryStore) AddEnvironment(newEnvironment Environment) (Environment, error) {
+	if err := ValidateEnvironment(newEnvironment); err != nil {
+		return Environment{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.state()
+	if existing, err := s.environmentByName(newEnvironment.Name); err == nil {
+		return Environment{}, fmt.Errorf("Environment named '%s' already exists with id: %d", existing.Name, existing.Id)
+	}
+
+	id, err := assignId(newEnvironment.Id, &s.sequences.Environments, func(id uint) bool {
+		_, err := s.environmentById(id)
+		return err == nil
+	})
+	if err != nil {
+		return Environment{}, err
+	}
+	newEnvironment.Id = id
+
+	newEnvironments := make([]Environment, len(s.environments), len(s.environments)+1)
+	copy(newEnvironments, s.environments)
+	s.environments = append(newEnvironments, newEnvironment)
+	return newEnvironment, s.save(before, ENVIRONMENTS)
+}
+
+func (s *MemoryStore) UpdateEnvironment(updated Environment) error {
+	if err := ValidateEnvironment(updated); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.state()
+	if existing, err := s.environmentByName(updated.Name); err == nil && existing.Id != updated.Id {
+		return fmt.Errorf("Environment named '%s' already exists with id: %d", existing.Name, existing.Id)
+	}
+
+	newEnvironments := make([]Environment, len(s.environments))
+	copy(newEnvironments, s.environments)
+
+	found := false
+	for i := 0; i < len(newEnvironments); i++ {
+		if newEnvironments[i].Id == updated.Id {
+			if newEnvironments[i].Name != updated.Name {
+				if d, ok := findDeployment(s.deployments, func(d Deployment) bool { return d.Environment.Id == updated.Id }); ok {
+					return environmentRenameError(newEnvironments[i], d)
+				}
+			}
+			newEnvironments[i] = updated
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("Unable to find environment with id: %d", updated.Id)
+	}
+
+	s.environments = newEnvironments
+
+	// deployments hold copies of their environment, so keep them in step
+	newDeployments := make([]Deployment, len(s.deployments))
+	copy(newDeployments, s.deployments)
+	for i := 0; i < len(newDeployments); i++ {
+		if newDeployments[i].Environment.Id == updated.Id {
+			newDeployments[i].Environment = updated
+		}
+	}
+	s.deployments = newDeployments
+
+	return s.save(before, ENVIRONMENTS)
+}
+
+func (s *MemoryStore) DeleteEnvironment(id uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.state()
+	for i := 0; i < len(s.deployments); i++ {
+		if s.deployments[i].Environment.Id == id {
+			return fmt.Errorf("Environment %d still has a deployment of '%s'", id, s.deployments[i].Project.ShortName)
+		}
+	}
+
+	newEnvironments := make([]Environment, 0, len(s.environments))
+	for i := 0; i < len(s.environments); i++ {
+		if s.environments[i].Id != id {
+			newEnvironments = append(newEnvironments, s.environments[i])
+		}
+	}
+	if len(newEnvironments) == len(s.environments) {
+		return fmt.Errorf("Unable to find environment with id: %d", id)
+	}
+
+	s.environments = newEnvironments
+	kinds := []string{ENVIRONMENTS}
+	if s.removeConfigValues(func(cv ConfigValues) bool { return cv.EnvironmentId == id }) {
+		kinds = append(kinds, VALUES)
+	}
+	if s.removeRevisions(func(r Revision) bool { return r.EnvironmentId == id }) {
+		kinds = append(kinds, REVISIONS)
+	}
+	return s.save(before, kinds...)
+}
+
+func (s *MemoryStore) GetDeployments() ([]Deployment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	deployments := make([]Deployment, len(s.deployments))
+	copy(deployments, s.deployments)
+	return deployments, nil
+}
+
+func (s *MemoryStore) GetDeploymentsByEnvironmentName(environmentName string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	environment, err := s.environmentByName(environmentName)
+	if err != nil {
+		return make(map[string]string), fmt.Errorf("Could not find environment with the name '%s'", environmentName)
+	}
+	return s.deploymentsByEnvironmentId(environment.Id), nil
+}
+
+func (s *MemoryStore) GetDeploymentsByEnvironmentId(id uint) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.deploymentsByEnvironmentId(id), nil
+}
+
+func (s *MemoryStore) deploymentsByEnvironmentId(id uint) map[string]string {
+	urlMap := make(map[string]string)
+
+	for i := 0; i < len(s.deployments); i++ {
+		d := s.deployments[i]
+		if d.Environment.Id == id {
+			urlMap[d.Project.ShortName] = d.Url()
+		}
+	}
+
+	return urlMap
+}
+
+func (s *MemoryStore) GetDeployment(environmentId, projectId uint) (Deployment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.deployment(environmentId, projectId)
+}
+
+func (s *MemoryStore) deployment(environmentId, projectId uint) (Deployment, error) {
+	for i := 0; i < len(s.deployments); i++ {
+		d := s.deployments[i]
+		if d.Environment.Id == environmentId && d.Project.Id == projectId {
+			return d, nil
+		}
+	}
+	return Deployment{}, fmt.Errorf("Project %d is not deployed to environment %d", projectId, environmentId)
+}
+
+// Records a project as deployed to an environment, allocating it
+// the lowest free port at or above the environment's starting port
+func (s *MemoryStore) AddDeployment(environmentId, projectId uint) (Deployment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.state()
+	environment, err := s.environmentById(environmentId)
+	if err != nil {
+		return Deployment{}, err
+	}
+	project, err := s.projectById(projectId)
+	if err != nil {
+		return Deployment{}, err
+	}
+	if _, err := s.deployment(environmentId, projectId); err == nil {
+		return Deployment{}, fmt.Errorf("Project '%s' is already deployed to environment '%s'", project.ShortName, environment.Name)
+	}
+
+	port, err := NextFreePort(environment, s.deployments)
+	if err != nil {
+		return Deployment{}, err
+	}
+
+	deployment := Deployment{Project: project, Environment: environment, Port: port}
+	newDeployments := make([]Deployment, len(s.deployments), len(s.deployments)+1)
+	copy(newDeployments, s.deployments)
+	s.deployments = append(newDeployments, deployment)
+	return deployment, s.save(before, DEPLOYMENTS)
+}
+
+// Moves a deployment to another port on its host
+func (s *MemoryStore) SetDeploymentPort(environmentId, projectId, port uint) (Deployment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.state()
+	deployment, err := s.deployment(environmentId, projectId)
+	if err != nil {
+		return Deployment{}, err
+	}
+	if err := checkPortFree(deployment, s.deployments, port); err != nil {
+		return Deployment{}, err
+	}
+
+	deployment.Port = port
+	newDeployments := make([]Deployment, len(s.deployments))
+	for i, d := range s.deployments {
+		if d.Environment.Id == environmentId && d.Project.Id == projectId {
+			d = deployment
+		}
+		newDeployments[i] = d
+	}
+	s.deployments = newDeployments
+	return deployment, s.save(before, DEPLOYMENTS)
+}
+
+func (s *MemoryStore) SetDeploymentStopped(environmentId, projectId uint, stopped bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.state()
+	if _, err := s.deployment(environmentId, projectId); err != nil {
+		return err
+	}
+
+	newDeployments := make([]Deployment, len(s.deployments))
+	for i, d := range s.deployments {
+		if d.Environment.Id == environmentId && d.Project.Id == projectId {
+			d.Stopped = stopped
+		}
+		newDeployments[i] = d
+	}
+	s.deployments = newDeployments
+	return s.save(before, DEPLOYMENTS)
+}
+
+func (s *MemoryStore) DeleteDeployment(environmentId, projectId uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.state()
+	newDeployments := make([]Deployment, 0, len(s.deployments))
+	for i := 0; i < len(s.deployments); i++ {
+		d := s.deployments[i]
+		if d.Environment.Id != environmentId || d.Project.Id != projectId {
+			newDeployments = append(newDeployments, d)
+		}
+	}
+	if len(newDeployments) == len(s.deployments) {
+		return fmt.Errorf("Project %d is not deployed to environment %d", projectId, environmentId)
+	}
+
+	s.deployments = newDeployments
+	return s.save(before, DEPLOYMENTS)
+}
+
+func (s *MemoryStore) GetTemplates() ([]JenkinsTemplate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	templates := make([]JenkinsTemplate, len(s.templates))
+	copy(templates, s.templates)
+	return templates, nil
+}
+
+func (s *MemoryStore) GetTemplateByName(templateName string) (*JenkinsTemplate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.templateByName(templateName)
+}
+
+func (s *MemoryStore) templateByName(templateName string) (*JenkinsTemplate, error) {
+	for _, template := range s.templates {
+		if template.Name == templateName {
+			return &template, nil
+		}
+	}
+	return nil, fmt.Errorf("Could not find template '%s'", templateName)
+}
+
+func (s *MemoryStore) AddTemplate(newTemplate JenkinsTemplate) error {
+	if err := ValidateTemplate(newTemplate); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.state()
+	if _, err := s.templateByName(newTemplate.Name); err == nil {
+		return fmt.Errorf("Template '%s' already exists", newTemplate.Name)
+	}
+
+	newTemplates := make([]JenkinsTemplate, len(s.templates), len(s.templates)+1)
+	copy(newTemplates, s.templates)
+	s.templates = append(newTemplates, newTemplate)
+	return s.save(before, TEMPLATES)
+}
+
+// Projects keep their own copy of the template they were created
+// with, so updating a template only affects jobs created afterwards
+func (s *MemoryStore) UpdateTemplate(updated JenkinsTemplate) error {
+	if err := ValidateTemplate(updated); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.state()
+	newTemplates := make([]JenkinsTemplate, len(s.templates))
+	copy(newTemplates, s.templates)
+
+	found := false
+	for i := 0; i < len(newTemplates); i++ {
+		if newTemplates[i].Name == updated.Name {
+			newTemplates[i] = updated
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("Could not find template '%s'", updated.Name)
+	}
+
+	s.templates = newTemplates
+	return s.save(before, TEMPLATES)
+}
+
+func (s *MemoryStore) DeleteTemplate(templateName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.state()
+	newTemplates := make([]JenkinsTemplate, 0, len(s.templates))
+	for i := 0; i < len(s.templates); i++ {
+		if s.templates[i].Name != templateName {
+			newTemplates = append(newTemplates, s.templates[i])
+		}
+	}
+	if len(newTemplates) == len(s.templates) {
+		return fmt.Errorf("Could not find template '%s'", templateName)
+	}
+
+	s.templates = newTemplates
+	return s.save(before, TEMPLATES)
+}
+
+func (s *MemoryStore) GetConfigValues(environmentId, projectId uint) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	values := make(map[string]string)
+	for _, cv := range s.configValues {
+		if cv.EnvironmentId == environmentId && cv.ProjectId == projectId {
+			for k, v := range cv.Values {
+				values[k] = v
+			}
+		}
+	}
+	return values, nil
+}
+
+// Replaces all values held for the environment/project pair
+func (s *MemoryStore) SetConfigValues(environmentId, projectId uint, values map[string]string) error {
+	if err := ValidateConfigValues(values); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.state()
+	if _, err := s.environmentById(environmentId); err != nil {
+		return err
+	}
+	if projectId != 0 {
+		if _, err := s.projectById(projectId); err != nil {
+			return err
+		}
+	}
+
+	copied := make(map[string]string, len(values))
+	for k, v := range values {
+		copied[k] = v
+	}
+
+	newValues := make([]ConfigValues, 0, len(s.configValues)+1)
+	for _, cv := range s.configValues {
+		if cv.EnvironmentId != environmentId || cv.ProjectId != projectId {
+			newValues = append(newValues, cv)
+		}
+	}
+	s.configValues = append(newValues, ConfigValues{environmentId, projectId, copied})
+	return s.save(before, VALUES)
+}
+
+func (s *MemoryStore) DeleteConfigValues(environmentId, projectId uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.state()
+	if s.removeConfigValues(func(cv ConfigValues) bool {
+		return cv.EnvironmentId == environmentId && cv.ProjectId == projectId
+	}) {
+		return s.save(before, VALUES)
+	}
+	return nil
+}
+
+// Drops the matching config values from memory, returning whether
+// there were any. The caller saves the change.
+func (s *MemoryStore) removeConfigValues(matches func(cv ConfigValues) bool) bool {
+	newValues := make([]ConfigValues, 0, len(s.configValues))
+	for _, cv := range s.configValues {
+		if !matches(cv) {
+			newValues = append(newValues, cv)
+		}
+	}
+	if len(newValues) == len(s.configValues) {
+		return false
+	}
+	s.configValues = newValues
+	return true
+}
+
+func (s *MemoryStore) GetRevisions(environmentId, projectId uint) ([]Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	revisions := make([]Revision, 0, 5)
+	for _, r := range s.revisions {
+		if r.EnvironmentId == environmentId && r.ProjectId == projectId {
+			revisions = append(revisions, copyRevision(r))
+		}
+	}
+	return revisions, nil
+}
+
+func (s *MemoryStore) GetRevision(environmentId, projectId, revision uint) (Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, r := range s.revisions {
+		if r.EnvironmentId == environmentId && r.ProjectId == projectId && r.Revision == revision {
+			return copyRevision(r), nil
+		}
+	}
+	return Revision{}, fmt.Errorf("Unable to find revision %d of project %d in environment %d", revision, projectId, environmentId)
+}
+
+func (s *MemoryStore) AddRevision(revision Revision) (Revision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.state()
+	if _, err := s.environmentById(revision.EnvironmentId); err != nil {
+		return Revision{}, err
+	}
+	if _, err := s.projectById(revision.ProjectId); err != nil {
+		return Revision{}, err
+	}
+
+	revision.Revision = 1
+	for _, r := range s.revisions {
+		if r.EnvironmentId == revision.EnvironmentId && r.ProjectId == revision.ProjectId && r.Revision >= revision.Revision {
+			revision.Revision = r.Revision + 1
+		}
+	}
+
+	revision = copyRevision(revision)
+	newRevisions := make([]Revision, len(s.revisions), len(s.revisions)+1)
+	copy(newRevisions, s.revisions)
+	s.revisions = append(newRevisions, revision)
+	return copyRevision(revision), s.save(before, REVISIONS)
+}
+
+// Drops the matching revisions from memory, returning whether there
+// were any. The caller saves the change.
+func (s *MemoryStore) removeRevisions(matches func(r Revision) bool) bool {
+	newRevisions := make([]Revision, 0, len(s.revisions))
+	for _, r := range s.revisions {
+		if !matches(r) {
+			newRevisions = append(newRevisions, r)
+		}
+	}
+	if len(newRevisions) == len(s.revisions) {
+		return false
+	}
+	s.revisions = newRevisions
+	return true
+}
+
+// revisions hold a map, which would otherwise be shared with callers
+func copyRevision(r Revision) Revision {
+	vars := make(map[string]string, len(r.EnvironmentVars))
+	for k, v := range r.EnvironmentVars {
+		vars[k] = v
+	}
+	r.EnvironmentVars = vars
+	return r
+}
@@ -0,0 +1,206 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	REDACTED          = "********"
+	encryptedPrefix   = "enc:v1:"
+	SECRET_KEY_LENGTH = 32
+)
+
+// A value that must never be shown. Secrets print and marshal as a
+// mask; Reveal returns the real value.
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return REDACTED
+}
+
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s Secret) Reveal() string {
+	return string(s)
+}
+
+func (s Secret) IsEncrypted() bool {
+	return strings.HasPrefix(string(s), encryptedPrefix)
+}
+
+// Sets a secret config field by its json name
+func (c *GoobernetConfig) SetSecret(name string, value Secret) error {
+	switch name {
+	case "jenkinsPassword":
+		c.JenkinsPassword = value
+	default:
+		return fmt.Errorf("Unknown secret '%s'", name)
+	}
+	return nil
+}
+
+// every secret in the config, for encrypting and decrypting in bulk
+func (c *GoobernetConfig) secrets() []*Secret {
+	// copied so that changing a secret can't reach back into a
+	// slice shared with the store
+	c.RegistryAuth = append([]RegistryAuth(nil), c.RegistryAuth...)
+
+	secrets := []*Secret{&c.JenkinsPassword}
+	for i := range c.RegistryAuth {
+		secrets = append(secrets, &c.RegistryAuth[i].Password)
+	}
+	return secrets
+}
+
+// Encrypts secrets at rest with AES-256-GCM
+type SecretKey struct {
+	aead cipher.AEAD
+}
+
+// Loads the key from file, or if that's empty from the file named by
+// GOOBERNET_SECRET_KEY_FILE, or from GOOBERNET_SECRET_KEY itself.
+// Keys are base64 encoded. Returns nil if no key is configured.
+func LoadSecretKey(file string) (*SecretKey, error) {
+	if file == "" {
+		file = os.Getenv("GOOBERNET_SECRET_KEY_FILE")
+	}
+
+	encoded := os.Getenv("GOOBERNET_SECRET_KEY")
+	if file != "" {
+		bytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading secret key: %s", err.Error())
+		}
+		encoded = string(bytes)
+	}
+	if strings.TrimSpace(encoded) == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("Secret key is not valid base64: %s", err.Error())
+	}
+	return NewSecretKey(raw)
+}
+
+func NewSecretKey(raw []byte) (*SecretKey, error) {
+	if len(raw) != SECRET_KEY_LENGTH {
+		return nil, fmt.Errorf("Secret key must be %d bytes, got %d", SECRET_KEY_LENGTH, len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretKey{aead}, nil
+}
+
+// Creates a random base64 encoded key, suitable for LoadSecretKey
+func GenerateSecretKey() (string, error) {
+	raw := make([]byte, SECRET_KEY_LENGTH)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+func (k *SecretKey) Encrypt(plain string) (Secret, error) {
+	if k == nil {
+		return "", errors.New("No secret key configured; set GOOBERNET_SECRET_KEY or GOOBERNET_SECRET_KEY_FILE")
+	}
+	if plain == "" {
+		return "", nil
+	}
+
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := k.aead.Seal(nonce, nonce, []byte(plain), nil)
+	return Secret(encryptedPrefix + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// Values that were never encrypted are returned as they are, so
+// config written before secrets were encrypted keeps working
+func (k *SecretKey) Decrypt(s Secret) (Secret, error) {
+	if !s.IsEncrypted() {
+		return s, nil
+	}
+	if k == nil {
+		return "", errors.New("Config contains encrypted secrets but no secret key is configured")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(string(s)[len(encryptedPrefix):])
+	if err != nil {
+		return "", fmt.Errorf("Encrypted secret is corrupt: %s", err.Error())
+	}
+	nonceSize := k.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", errors.New("Encrypted secret is corrupt: too short")
+	}
+	plain, err := k.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", errors.New("Unable to decrypt secret, is this the right key?")
+	}
+	return Secret(plain), nil
+}
+
+// Returns a copy of the config with every secret decrypted
+func (k *SecretKey) DecryptConfig(c GoobernetConfig) (GoobernetConfig, error) {
+	for _, secret := range c.secrets() {
+		plain, err := k.Decrypt(*secret)
+		if err != nil {
+			return c, err
+		}
+		*secret = plain
+	}
+	return c, nil
+}
+
+// Encrypts any secrets in the stored config that are still plain
+// text. Returns whether anything changed.
+func (k *SecretKey) EncryptStoredSecrets(store Store) (bool, error) {
+	c, err := store.GetConfig()
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	for _, secret := range c.secrets() {
+		if *secret == "" || secret.IsEncrypted() {
+			continue
+		}
+		encrypted, err := k.Encrypt(secret.Reveal())
+		if err != nil {
+			return false, err
+		}
+		*secret = encrypted
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, store.SaveConfig(c)
+}
@@ -0,0 +1,205 @@
+package data
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mustGenerateKey(t *testing.T) *SecretKey {
+	t.Helper()
+	encoded, err := GenerateSecretKey()
+	if err != nil {
+		t.Fatalf("GenerateSecretKey: %s", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("generated key isn't base64: %s", err)
+	}
+	key, err := NewSecretKey(raw)
+	if err != nil {
+		t.Fatalf("NewSecretKey: %s", err)
+	}
+	return key
+}
+
+func TestSecretRedacts(t *testing.T) {
+	s := Secret("hunter2")
+	for name, shown := range map[string]string{
+		"String":   s.String(),
+		"%v":       fmt.Sprintf("%v", s),
+		"%#v":      fmt.Sprintf("%#v", s),
+		"%+v":      fmt.Sprintf("%+v", GoobernetConfig{JenkinsPassword: s}),
+		"json":     mustMarshal(t, GoobernetConfig{JenkinsPassword: s}),
+		"registry": mustMarshal(t, RegistryAuth{Password: s}),
+	} {
+		if strings.Contains(shown, "hunter2") {
+			t.Errorf("%s shows the secret: %s", name, shown)
+		}
+	}
+	if s.Reveal() != "hunter2" {
+		t.Errorf("Reveal = '%s', want hunter2", s.Reveal())
+	}
+	if Secret("").String() != "" {
+		t.Errorf("an empty secret should print as empty, not masked")
+	}
+}
+
+func mustMarshal(t *testing.T, obj interface{}) string {
+	t.Helper()
+	bytes, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	return string(bytes)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := mustGenerateKey(t)
+
+	tests := []string{"hunter2", "with spaces and ünïcödé", strings.Repeat("long", 100)}
+	for _, plain := range tests {
+		encrypted, err := key.Encrypt(plain)
+		if err != nil {
+			t.Fatalf("Encrypt: %s", err)
+		}
+		if !encrypted.IsEncrypted() || strings.Contains(encrypted.Reveal(), plain) {
+			t.Errorf("Encrypt(%q) = %q, want it encrypted", plain, encrypted.Reveal())
+		}
+		decrypted, err := key.Decrypt(encrypted)
+		if err != nil || decrypted.Reveal() != plain {
+			t.Errorf("Decrypt(Encrypt(%q)) = %q, %v", plain, decrypted.Reveal(), err)
+		}
+	}
+
+	// each encryption gets its own nonce
+	a, _ := key.Encrypt("same")
+	b, _ := key.Encrypt("same")
+	if a == b {
+		t.Errorf("encrypting the same value twice gave the same result")
+	}
+
+	if empty, err := key.Encrypt(""); err != nil || empty != "" {
+		t.Errorf("Encrypt(\"\") = %q, %v; want it left empty", empty.Reveal(), err)
+	}
+}
+
+func TestDecryptErrors(t *testing.T) {
+	key := mustGenerateKey(t)
+	encrypted, err := key.Encrypt("hunter2")
+	if err != nil {
+		t.Fatalf("Encrypt: %s", err)
+	}
+	var noKey *SecretKey
+
+	tests := []struct {
+		name   string
+		key    *SecretKey
+		secret Secret
+	}{
+		{"wrong key", mustGenerateKey(t), encrypted},
+		{"no key", noKey, encrypted},
+		{"not base64", key, Secret(encryptedPrefix + "!!!")},
+		{"too short", key, Secret(encryptedPrefix + base64.StdEncoding.EncodeToString([]byte("abc")))},
+		{"tampered", key, encrypted[:len(encrypted)-4] + "AAAA"},
+	}
+	for _, test := range tests {
+		if _, err := test.key.Decrypt(test.secret); err == nil {
+			t.Errorf("%s: Decrypt succeeded", test.name)
+		}
+	}
+
+	// plain text from before secrets were encrypted passes through
+	if plain, err := noKey.Decrypt("hunter2"); err != nil || plain != "hunter2" {
+		t.Errorf("Decrypt of plain text = %q, %v; want it unchanged", plain.Reveal(), err)
+	}
+	if _, err := noKey.Encrypt("hunter2"); err == nil {
+		t.Errorf("Encrypt without a key succeeded")
+	}
+}
+
+func TestEncryptStoredSecrets(t *testing.T) {
+	key := mustGenerateKey(t)
+	store := NewMemoryStore(GoobernetConfig{
+		JenkinsPassword: "hunter2",
+		RegistryAuth:    []RegistryAuth{{"registry:5000", "deployer", "s3cret"}, {"other:5000", "nobody", ""}},
+	})
+
+	changed, err := key.EncryptStoredSecrets(store)
+	if err != nil || !changed {
+		t.Fatalf("EncryptStoredSecrets = %v, %v; want changes", changed, err)
+	}
+	stored, _ := store.GetConfig()
+	if !stored.JenkinsPassword.IsEncrypted() || !stored.RegistryAuth[0].Password.IsEncrypted() {
+		t.Errorf("stored secrets weren't encrypted: %q, %q", stored.JenkinsPassword.Reveal(), stored.RegistryAuth[0].Password.Reveal())
+	}
+	if stored.RegistryAuth[1].Password != "" {
+		t.Errorf("an empty password was encrypted")
+	}
+
+	if changed, err := key.EncryptStoredSecrets(store); err != nil || changed {
+		t.Errorf("second EncryptStoredSecrets = %v, %v; want nothing left to do", changed, err)
+	}
+
+	stored, _ = store.GetConfig()
+	decrypted, err := key.DecryptConfig(stored)
+	if err != nil {
+		t.Fatalf("DecryptConfig: %s", err)
+	}
+	if decrypted.JenkinsPassword != "hunter2" || decrypted.RegistryAuth[0].Password != "s3cret" {
+		t.Errorf("DecryptConfig = %q, %q", decrypted.JenkinsPassword.Reveal(), decrypted.RegistryAuth[0].Password.Reveal())
+	}
+	// decrypting a copy mustn't reach back into the store
+	if stored, _ = store.GetConfig(); !stored.RegistryAuth[0].Password.IsEncrypted() {
+		t.Errorf("DecryptConfig changed the stored config")
+	}
+}
+
+func TestLoadSecretKey(t *testing.T) {
+	encoded, err := GenerateSecretKey()
+	if err != nil {
+		t.Fatalf("GenerateSecretKey: %s", err)
+	}
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		return path
+	}
+	shortKey := base64.StdEncoding.EncodeToString([]byte("too short"))
+
+	tests := []struct {
+		name    string
+		file    string
+		env     string
+		wantKey bool
+		wantErr bool
+	}{
+		{name: "nothing configured"},
+		{name: "file", file: write("key", encoded+"\n"), wantKey: true},
+		{name: "environment", env: encoded, wantKey: true},
+		{name: "file beats environment", file: write("bad", "not base64!"), env: encoded, wantErr: true},
+		{name: "missing file", file: filepath.Join(dir, "missing"), wantErr: true},
+		{name: "wrong length", env: shortKey, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("GOOBERNET_SECRET_KEY_FILE", "")
+			t.Setenv("GOOBERNET_SECRET_KEY", test.env)
+
+			key, err := LoadSecretKey(test.file)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("LoadSecretKey error = %v, want error %v", err, test.wantErr)
+			}
+			if (key != nil) != test.wantKey {
+				t.Errorf("LoadSecretKey key = %v, want key %v", key != nil, test.wantKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,1062 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS config (
+	id               INTEGER PRIMARY KEY CHECK (id = 1),
+	jenkins_url      TEXT NOT NULL DEFAULT '',
+	jenkins_username TEXT NOT NULL DEFAULT '',
+	jenkins_password TEXT NOT NULL DEFAULT '',
+	registry         TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS registry_auth (
+	registry TEXT PRIMARY KEY,
+	username TEXT NOT NULL DEFAULT '',
+	password TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS templates (
+	name        TEXT PRIMARY KEY,
+	description TEXT NOT NULL DEFAULT '',
+	content     TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS projects (
+	id                   INTEGER PRIMARY KEY,
+	name                 TEXT NOT NULL,
+	short_name           TEXT NOT NULL UNIQUE COLLATE NOCASE,
+	description          TEXT NOT NULL DEFAULT '',
+	email                TEXT NOT NULL DEFAULT '',
+	contact_name         TEXT NOT NULL DEFAULT '',
+	github_url           TEXT NOT NULL DEFAULT '',
+	template_name        TEXT NOT NULL DEFAULT '',
+	template_description TEXT NOT NULL DEFAULT '',
+	template_content     TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS environments (
+	id            INTEGER PRIMARY KEY,
+	name          TEXT NOT NULL UNIQUE COLLATE NOCASE,
+	hostname      TEXT NOT NULL,
+	goobernet_url TEXT NOT NULL DEFAULT '',
+	starting_port INTEGER NOT NULL,
+	registry      TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS deployments (
+	environment_id INTEGER NOT NULL REFERENCES environments(id),
+	project_id     INTEGER NOT NULL REFERENCES projects(id),
+	port           INTEGER NOT NULL,
+	PRIMARY KEY (environment_id, project_id)
+);
+
+-- project_id 0 holds the environment-wide defaults
+CREATE TABLE IF NOT EXISTS config_values (
+	environment_id INTEGER NOT NULL REFERENCES environments(id) ON DELETE CASCADE,
+	project_id     INTEGER NOT NULL DEFAULT 0,
+	name           TEXT NOT NULL,
+	value          TEXT NOT NULL,
+	PRIMARY KEY (environment_id, project_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS revisions (
+	environment_id   INTEGER NOT NULL REFERENCES environments(id) ON DELETE CASCADE,
+	project_id       INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+	revision         INTEGER NOT NULL,
+	image            TEXT NOT NULL,
+	tag              TEXT NOT NULL DEFAULT '',
+	digest           TEXT NOT NULL DEFAULT '',
+	build_number     INTEGER NOT NULL DEFAULT 0,
+	port             INTEGER NOT NULL,
+	environment_vars TEXT NOT NULL DEFAULT '{}',
+	triggered_by     TEXT NOT NULL DEFAULT '',
+	timestamp        TIMESTAMP NOT NULL,
+	rollback_of      INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (environment_id, project_id, revision)
+);
+
+CREATE TABLE IF NOT EXISTS sequences (
+	name  TEXT PRIMARY KEY,
+	value INTEGER NOT NULL
+);
+
+INSERT OR IGNORE INTO sequences (name, value) SELECT 'projects', COALESCE(MAX(id), 0) FROM projects;
+INSERT OR IGNORE INTO sequences (name, value) SELECT 'environments', COALESCE(MAX(id), 0) FROM environments;
+
+CREATE TABLE IF NOT EXISTS migrations (
+	name       TEXT PRIMARY KEY,
+	applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+`
+
+const (
+	projectColumns     = "p.id, p.name, p.short_name, p.description, p.email, p.contact_name, p.github_url, p.template_name, p.template_description, p.template_content, p.health_check"
+	environmentColumns = "e.id, e.name, e.hostname, e.goobernet_url, e.starting_port, e.registry"
+	deploymentQuery    = "SELECT " + projectColumns + ", " + environmentColumns + ", d.port, d.stopped FROM deployments d JOIN projects p ON p.id = d.project_id JOIN environments e ON e.id = d.environment_id"
+)
+
+// Keeps state in an SQLite database. Deployments reference projects
+// and environments by foreign key, so they always see current values.
+type SqlStore struct {
+	db *sql.DB
+}
+
+// satisfied by both *sql.DB and *sql.Tx
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// satisfied by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Opens (creating if needed) the database at path
+func OpenSqlStore(path string) (*SqlStore, error) {
+	// immediate transactions stop two writers allocating the same port
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on&_txlock=immediate&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqlSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error creating schema: %s", err.Error())
+	}
+	if _, err := db.Exec("INSERT OR IGNORE INTO config (id) VALUES (1)"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	store := &SqlStore{db}
+	if err := store.migrateSchema(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error migrating schema: %s", err.Error())
+	}
+	return store, nil
+}
+
+// Opens an existing database without creating, migrating or importing
+// anything. It fails if goobernet hasn't yet brought the schema up to
+// date, as the queries would fail on the missing columns.
+func OpenSqlStoreReadOnly(path string) (*SqlStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&_foreign_keys=on&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	store := &SqlStore{db}
+	for _, m := range schemaMigrations {
+		done, err := store.migrated(m.name)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("Error reading schema: %s", err.Error())
+		}
+		if !done {
+			db.Close()
+			return nil, fmt.Errorf("Database at %s needs migrating (%s); start goobernet against it first", path, m.name)
+		}
+	}
+	return store, nil
+}
+
+// Columns added after their table was first created. CREATE TABLE IF
+// NOT EXISTS leaves existing tables alone, so they're added here.
+var schemaMigrations = []struct {
+	name string
+	stmt string
+}{
+	{"project-health-check", "ALTER TABLE projects ADD COLUMN health_check TEXT NOT NULL DEFAULT '{}'"},
+	{"deployment-stopped", "ALTER TABLE deployments ADD COLUMN stopped INTEGER NOT NULL DEFAULT 0"},
+}
+
+func (s *SqlStore) migrateSchema() error {
+	for _, m := range schemaMigrations {
+		err := s.inTx(func(tx *sql.Tx) error {
+			var done int
+			if err := tx.QueryRow("SELECT COUNT(*) FROM migrations WHERE name = ?", m.name).Scan(&done); err != nil {
+				return err
+			}
+			if done > 0 {
+				return nil
+			}
+			if _, err := tx.Exec(m.stmt); err != nil {
+				return err
+			}
+			_, err := tx.Exec("INSERT INTO migrations (name) VALUES (?)", m.name)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %s", m.name, err.Error())
+		}
+	}
+	return nil
+}
+
+func (s *SqlStore) migrated(name string) (bool, error) {
+	var done int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM migrations WHERE name = ?", name).Scan(&done)
+	return done > 0, err
+}
+
+func (s *SqlStore) Close() error {
+	return s.db.Close()
+}
+
+// Runs fn in a transaction, committing if it returns nil
+func (s *SqlStore) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SqlStore) GetConfig() (GoobernetConfig, error) {
+	var c GoobernetConfig
+	err := s.db.QueryRow("SELECT jenkins_url, jenkins_username, jenkins_password, registry FROM config WHERE id = 1").
+		Scan(&c.JenkinsUrl, &c.JenkinsUsername, &c.JenkinsPassword, &c.Registry)
+	if err != nil {
+		return GoobernetConfig{}, fmt.Errorf("Error reading config: %s", err.Error())
+	}
+
+	rows, err := s.db.Query("SELECT registry, username, password FROM registry_auth ORDER BY registry")
+	if err != nil {
+		return GoobernetConfig{}, fmt.Errorf("Error reading registry credentials: %s", err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a RegistryAuth
+		if err := rows.Scan(&a.Registry, &a.Username, &a.Password); err != nil {
+			return GoobernetConfig{}, fmt.Errorf("Error reading registry credentials: %s", err.Error())
+		}
+		c.RegistryAuth = append(c.RegistryAuth, a)
+	}
+	if err := rows.Err(); err != nil {
+		return GoobernetConfig{}, fmt.Errorf("Error reading registry credentials: %s", err.Error())
+	}
+	return c, nil
+}
+
+func (s *SqlStore) SaveConfig(config GoobernetConfig) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		return saveSqlConfig(tx, config)
+	})
+}
+
+func saveSqlConfig(q querier, c GoobernetConfig) error {
+	_, err := q.Exec("UPDATE config SET jenkins_url = ?, jenkins_username = ?, jenkins_password = ?, registry = ? WHERE id = 1",
+		c.JenkinsUrl, c.JenkinsUsername, c.JenkinsPassword, c.Registry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := q.Exec("DELETE FROM registry_auth"); err != nil {
+		return err
+	}
+	for _, a := range c.RegistryAuth {
+		_, err := q.Exec("INSERT INTO registry_auth (registry, username, password) VALUES (?, ?, ?)", a.Registry, a.Username, a.Password)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* --------------------------------------------------*/
+
+// Projects
+
+// Destinations for projectColumns. The health check is stored as
+// JSON, so it's scanned into check for the caller to unmarshal.
+func projectDest(p *Project, check *string) []interface{} {
+	return []interface{}{&p.Id, &p.Name, &p.ShortName, &p.Description, &p.Email, &p.ContactName, &p.GithubUrl,
+		&p.BuildTemplate.Name, &p.BuildTemplate.Description, &p.BuildTemplate.Content, check}
+}
+
+func scanProject(row scanner, p *Project) error {
+	var check string
+	if err := row.Scan(projectDest(p, &check)...); err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(check), &p.HealthCheck)
+}
+
+func (s *SqlStore) GetProjects() ([]Project, error) {
+	rows, err := s.db.Query("SELECT " + projectColumns + " FROM projects p ORDER BY p.short_name")
+	if err != nil {
+		return nil, fmt.Errorf("Error reading projects: %s", err.Error())
+	}
+	defer rows.Close()
+
+	projects := make([]Project, 0, 5)
+	for rows.Next() {
+		var p Project
+		if err := scanProject(rows, &p); err != nil {
+			return nil, fmt.Errorf("Error reading project: %s", err.Error())
+		}
+		projects = append(projects, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading projects: %s", err.Error())
+	}
+	return projects, nil
+}
+
+func (s *SqlStore) GetProjectById(id uint) (Project, error) {
+	var p Project
+	err := scanProject(s.db.QueryRow("SELECT "+projectColumns+" FROM projects p WHERE p.id = ?", id), &p)
+	if err == sql.ErrNoRows {
+		return Project{}, fmt.Errorf("Unable to find project with id: %d", id)
+	}
+	return p, err
+}
+
+func (s *SqlStore) GetProjectByShortName(shortName string) (Project, error) {
+	var p Project
+	err := scanProject(s.db.QueryRow("SELECT "+projectColumns+" FROM projects p WHERE p.short_name = ?", shortName), &p)
+	if err == sql.ErrNoRows {
+		return Project{}, fmt.Errorf("Unable to find project with short name '%s'", shortName)
+	}
+	return p, err
+}
+
+// Assigns the project an id unless it already has one
+func (s *SqlStore) AddProject(newProject Project) (Project, error) {
+	if err := ValidateProject(newProject); err != nil {
+		return Project{}, err
+	}
+	if existing, err := s.GetProjectByShortName(newProject.ShortName); err == nil {
+		return Project{}, fmt.Errorf("Project with short name '%s' already exists with id: %d", existing.ShortName, existing.Id)
+	}
+
+	err := s.inTx(func(tx *sql.Tx) error {
+		id, err := assignSqlId(tx, "projects", newProject.Id)
+		if err != nil {
+			return err
+		}
+		newProject.Id = id
+		return insertSqlProject(tx, newProject)
+	})
+	if err != nil {
+		return Project{}, err
+	}
+	return newProject, nil
+}
+
+func insertSqlProject(q querier, p Project) error {
+	check, err := json.Marshal(p.HealthCheck)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(`INSERT INTO projects (id, name, short_name, description, email, contact_name, github_url,
+			template_name, template_description, template_content, health_check) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.Id, p.Name, p.ShortName, p.Description, p.Email, p.ContactName, p.GithubUrl,
+		p.BuildTemplate.Name, p.BuildTemplate.Description, p.BuildTemplate.Content, string(check))
+	return err
+}
+
+func (s *SqlStore) UpdateProject(updated Project) error {
+	if err := ValidateProject(updated); err != nil {
+		return err
+	}
+
+	if existing, err := s.GetProjectByShortName(updated.ShortName); err == nil && existing.Id != updated.Id {
+		return fmt.Errorf("Project with short name '%s' already exists with id: %d", existing.ShortName, existing.Id)
+	}
+
+	p := updated
+	check, err := json.Marshal(p.HealthCheck)
+	if err != nil {
+		return err
+	}
+
+	// in the same transaction, so nothing can be deployed between the check and the rename
+	return s.inTx(func(tx *sql.Tx) error {
+		var existing Project
+		err := scanProject(tx.QueryRow("SELECT "+projectColumns+" FROM projects p WHERE p.id = ?", updated.Id), &existing)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("Unable to find project with id: %d", updated.Id)
+		}
+		if err != nil {
+			return err
+		}
+		if existing.ShortName != updated.ShortName {
+			deployments, err := getSqlDeployments(tx, "WHERE d.project_id = ?", updated.Id)
+			if err != nil {
+				return err
+			}
+			if len(deployments) > 0 {
+				return projectRenameError(existing, deployments[0])
+			}
+		}
+
+		res, err := tx.Exec(`UPDATE projects SET name = ?, short_name = ?, description = ?, email = ?, contact_name = ?,
+				github_url = ?, template_name = ?, template_description = ?, template_content = ?, health_check = ? WHERE id = ?`,
+			p.Name, p.ShortName, p.Description, p.Email, p.ContactName, p.GithubUrl,
+			p.BuildTemplate.Name, p.BuildTemplate.Description, p.BuildTemplate.Content, string(check), p.Id)
+		return checkAffected(res, err, fmt.Errorf("Unable to find project with id: %d", updated.Id))
+	})
+}
+
+func (s *SqlStore) DeleteProject(id uint) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		var envName string
+		err := tx.QueryRow("SELECT e.name FROM deployments d JOIN environments e ON e.id = d.environment_id WHERE d.project_id = ?", id).Scan(&envName)
+		if err == nil {
+			return fmt.Errorf("Project %d is still deployed to environment '%s'", id, envName)
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		res, err := tx.Exec("DELETE FROM projects WHERE id = ?", id)
+		if err := checkAffected(res, err, fmt.Errorf("Unable to find project with id: %d", id)); err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM config_values WHERE project_id = ?", id)
+		return err
+	})
+}
+
+/* --------------------------------------------------*/
+
+// Environments
+
+func scanEnvironment(row scanner, e *Environment) error {
+	return row.Scan(&e.Id, &e.Name, &e.Hostname, &e.GoobenetUrl, &e.StartingPort, &e.Registry)
+}
+
+func (s *SqlStore) GetEnvironments() ([]Environment, error) {
+	rows, err := s.db.Query("SELECT " + environmentColumns + " FROM environments e ORDER BY e.id")
+	if err != nil {
+		return nil, fmt.Errorf("Error reading environments: %s", err.Error())
+	}
+	defer rows.Close()
+
+	environments := make([]Environment, 0, 5)
+	for rows.Next() {
+		var e Environment
+		if err := scanEnvironment(rows, &e); err != nil {
+			return nil, fmt.Errorf("Error reading environment: %s", err.Error())
+		}
+		environments = append(environments, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading environments: %s", err.Error())
+	}
+	return environments, nil
+}
+
+func (s *SqlStore) GetEnvironmentById(id uint) (Environment, error) {
+	return getSqlEnvironmentById(s.db, id)
+}
+
+func getSqlEnvironmentById(q querier, id uint) (Environment, error) {
+	var e Environment
+	err := scanEnvironment(q.QueryRow("SELECT "+environmentColumns+" FROM environments e WHERE e.id = ?", id), &e)
+	if err == sql.ErrNoRows {
+		return Environment{}, fmt.Errorf("Unable to find environment with id: %d", id)
+	}
+	return e, err
+}
+
+func (s *SqlStore) GetEnvironmentByName(name string) (Environment, error) {
+	var e Environment
+	err := scanEnvironment(s.db.QueryRow("SELECT "+environmentColumns+" FROM environments e WHERE e.name = ?", name), &e)
+	if err == sql.ErrNoRows {
+		return Environment{}, fmt.Errorf("Unable to find environment named '%s'", name)
+	}
+	return e, err
+}
+
+// Assigns the environment an id unless it already has one
+func (s *SqlStore) AddEnvironment(newEnvironment Environment) (Environment, error) {
+	if err := ValidateEnvironment(newEnvironment); err != nil {
+		return Environment{}, err
+	}
+	if existing, err := s.GetEnvironmentByName(newEnvironment.Name); err == nil {
+		return Environment{}, fmt.Errorf("Environment named '%s' already exists with id: %d", existing.Name, existing.Id)
+	}
+
+	err := s.inTx(func(tx *sql.Tx) error {
+		id, err := assignSqlId(tx, "environments", newEnvironment.Id)
+		if err != nil {
+			return err
+		}
+		newEnvironment.Id = id
+		return insertSqlEnvironment(tx, newEnvironment)
+	})
+	if err != nil {
+		return Environment{}, err
+	}
+	return newEnvironment, nil
+}
+
+func insertSqlEnvironment(q querier, e Environment) error {
+	_, err := q.Exec("INSERT INTO environments (id, name, hostname, goobernet_url, starting_port, registry) VALUES (?, ?, ?, ?, ?, ?)",
+		e.Id, e.Name, e.Hostname, e.GoobenetUrl, e.StartingPort, e.Registry)
+	return err
+}
+
+func (s *SqlStore) UpdateEnvironment(updated Environment) error {
+	if err := ValidateEnvironment(updated); err != nil {
+		return err
+	}
+	if existing, err := s.GetEnvironmentByName(updated.Name); err == nil && existing.Id != updated.Id {
+		return fmt.Errorf("Environment named '%s' already exists with id: %d", existing.Name, existing.Id)
+	}
+
+	// in the same transaction, so nothing can be deployed between the check and the rename
+	return s.inTx(func(tx *sql.Tx) error {
+		existing, err := getSqlEnvironmentById(tx, updated.Id)
+		if err != nil {
+			return err
+		}
+		if existing.Name != updated.Name {
+			deployments, err := getSqlDeployments(tx, "WHERE d.environment_id = ?", updated.Id)
+			if err != nil {
+				return err
+			}
+			if len(deployments) > 0 {
+				return environmentRenameError(existing, deployments[0])
+			}
+		}
+
+		e := updated
+		res, err := tx.Exec("UPDATE environments SET name = ?, hostname = ?, goobernet_url = ?, starting_port = ?, registry = ? WHERE id = ?",
+			e.Name, e.Hostname, e.GoobenetUrl, e.StartingPort, e.Registry, e.Id)
+		return checkAffected(res, err, fmt.Errorf("Unable to find environment with id: %d", updated.Id))
+	})
+}
+
+func (s *SqlStore) DeleteEnvironment(id uint) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		var shortName string
+		err := tx.QueryRow("SELECT p.short_name FROM deployments d JOIN projects p ON p.id = d.project_id WHERE d.environment_id = ?", id).Scan(&shortName)
+		if err == nil {
+			return fmt.Errorf("Environment %d still has a deployment of '%s'", id, shortName)
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		res, err := tx.Exec("DELETE FROM environments WHERE id = ?", id)
+		return checkAffected(res, err, fmt.Errorf("Unable to find environment with id: %d", id))
+	})
+}
+
+/* --------------------------------------------------*/
+
+// Deployments
+
+func scanDeployment(row scanner, d *Deployment) error {
+	var check string
+	e := &d.Environment
+	dest := append(projectDest(&d.Project, &check),
+		&e.Id, &e.Name, &e.Hostname, &e.GoobenetUrl, &e.StartingPort, &e.Registry,
+		&d.Port, &d.Stopped)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(check), &d.Project.HealthCheck)
+}
+
+func (s *SqlStore) GetDeployments() ([]Deployment, error) {
+	deployments, err := getSqlDeployments(s.db, "")
+	if err != nil {
+		return nil, fmt.Errorf("Error reading deployments: %s", err.Error())
+	}
+	return deployments, nil
+}
+
+// Returns nil rather than the rows read so far if any row fails
+func getSqlDeployments(q querier, where string, args ...interface{}) ([]Deployment, error) {
+	rows, err := q.Query(deploymentQuery+" "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deployments := make([]Deployment, 0, 10)
+	for rows.Next() {
+		var d Deployment
+		if err := scanDeployment(rows, &d); err != nil {
+			return nil, err
+		}
+		deployments = append(deployments, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return deployments, nil
+}
+
+func (s *SqlStore) GetDeploymentsByEnvironmentName(environmentName string) (map[string]string, error) {
+	environment, err := s.GetEnvironmentByName(environmentName)
+	if err != nil {
+		return make(map[string]string), fmt.Errorf("Could not find environment with the name '%s'", environmentName)
+	}
+	return s.GetDeploymentsByEnvironmentId(environment.Id)
+}
+
+func (s *SqlStore) GetDeploymentsByEnvironmentId(id uint) (map[string]string, error) {
+	urlMap := make(map[string]string)
+
+	deployments, err := getSqlDeployments(s.db, "WHERE d.environment_id = ?", id)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading deployments: %s", err.Error())
+	}
+	for _, d := range deployments {
+		urlMap[d.Project.ShortName] = d.Url()
+	}
+	return urlMap, nil
+}
+
+func (s *SqlStore) GetDeployment(environmentId, projectId uint) (Deployment, error) {
+	var d Deployment
+	err := scanDeployment(s.db.QueryRow(deploymentQuery+" WHERE d.environment_id = ? AND d.project_id = ?", environmentId, projectId), &d)
+	if err == sql.ErrNoRows {
+		return Deployment{}, fmt.Errorf("Project %d is not deployed to environment %d", projectId, environmentId)
+	}
+	return d, err
+}
+
+// Records a project as deployed to an environment, allocating it
+// the lowest free port at or above the environment's starting port
+func (s *SqlStore) AddDeployment(environmentId, projectId uint) (Deployment, error) {
+	var deployment Deployment
+	err := s.inTx(func(tx *sql.Tx) error {
+		environment, err := getSqlEnvironmentById(tx, environmentId)
+		if err != nil {
+			return err
+		}
+		var project Project
+		err = scanProject(tx.QueryRow("SELECT "+projectColumns+" FROM projects p WHERE p.id = ?", projectId), &project)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("Unable to find project with id: %d", projectId)
+		}
+		if err != nil {
+			return err
+		}
+
+		deployments, err := getSqlDeployments(tx, "WHERE e.hostname = ?", environment.Hostname)
+		if err != nil {
+			return err
+		}
+		for _, d := range deployments {
+			if d.Environment.Id == environmentId && d.Project.Id == projectId {
+				return fmt.Errorf("Project '%s' is already deployed to environment '%s'", project.ShortName, environment.Name)
+			}
+		}
+
+		port, err := NextFreePort(environment, deployments)
+		if err != nil {
+			return err
+		}
+
+		deployment = Deployment{Project: project, Environment: environment, Port: port}
+		return insertSqlDeployment(tx, DeploymentJoin{EnvironmentId: environmentId, ProjectId: projectId, Port: port})
+	})
+	return deployment, err
+}
+
+func insertSqlDeployment(q querier, join DeploymentJoin) error {
+	_, err := q.Exec("INSERT INTO deployments (environment_id, project_id, port, stopped) VALUES (?, ?, ?, ?)",
+		join.EnvironmentId, join.ProjectId, join.Port, join.Stopped)
+	return err
+}
+
+// Moves a deployment to another port on its host
+func (s *SqlStore) SetDeploymentPort(environmentId, projectId, port uint) (Deployment, error) {
+	var deployment Deployment
+	err := s.inTx(func(tx *sql.Tx) error {
+		err := scanDeployment(tx.QueryRow(deploymentQuery+" WHERE d.environment_id = ? AND d.project_id = ?", environmentId, projectId), &deployment)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("Project %d is not deployed to environment %d", projectId, environmentId)
+		}
+		if err != nil {
+			return err
+		}
+
+		deployments, err := getSqlDeployments(tx, "WHERE e.hostname = ?", deployment.Environment.Hostname)
+		if err != nil {
+			return err
+		}
+		if err := checkPortFree(deployment, deployments, port); err != nil {
+			return err
+		}
+
+		deployment.Port = port
+		_, err = tx.Exec("UPDATE deployments SET port = ? WHERE environment_id = ? AND project_id = ?", port, environmentId, projectId)
+		return err
+	})
+	if err != nil {
+		return Deployment{}, err
+	}
+	return deployment, nil
+}
+
+func (s *SqlStore) SetDeploymentStopped(environmentId, projectId uint, stopped bool) error {
+	res, err := s.db.Exec("UPDATE deployments SET stopped = ? WHERE environment_id = ? AND project_id = ?", stopped, environmentId, projectId)
+	return checkAffected(res, err, fmt.Errorf("Project %d is not deployed to environment %d", projectId, environmentId))
+}
+
+func (s *SqlStore) DeleteDeployment(environmentId, projectId uint) error {
+	res, err := s.db.Exec("DELETE FROM deployments WHERE environment_id = ? AND project_id = ?", environmentId, projectId)
+	return checkAffected(res, err, fmt.Errorf("Project %d is not deployed to environment %d", projectId, environmentId))
+}
+
+/* --------------------------------------------------*/
+
+// Templates
+
+func (s *SqlStore) GetTemplates() ([]JenkinsTemplate, error) {
+	rows, err := s.db.Query("SELECT name, description, content FROM templates ORDER BY rowid")
+	if err != nil {
+		return nil, fmt.Errorf("Error reading templates: %s", err.Error())
+	}
+	defer rows.Close()
+
+	templates := make([]JenkinsTemplate, 0, 5)
+	for rows.Next() {
+		var t JenkinsTemplate
+		if err := rows.Scan(&t.Name, &t.Description, &t.Content); err != nil {
+			return nil, fmt.Errorf("Error reading template: %s", err.Error())
+		}
+		templates = append(templates, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading templates: %s", err.Error())
+	}
+	return templates, nil
+}
+
+func (s *SqlStore) GetTemplateByName(templateName string) (*JenkinsTemplate, error) {
+	var t JenkinsTemplate
+	err := s.db.QueryRow("SELECT name, description, content FROM templates WHERE name = ?", templateName).
+		Scan(&t.Name, &t.Description, &t.Content)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("Could not find template '%s'", templateName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *SqlStore) AddTemplate(newTemplate JenkinsTemplate) error {
+	if err := ValidateTemplate(newTemplate); err != nil {
+		return err
+	}
+	if _, err := s.GetTemplateByName(newTemplate.Name); err == nil {
+		return fmt.Errorf("Template '%s' already exists", newTemplate.Name)
+	}
+	return insertSqlTemplate(s.db, newTemplate)
+}
+
+func insertSqlTemplate(q querier, t JenkinsTemplate) error {
+	_, err := q.Exec("INSERT INTO templates (name, description, content) VALUES (?, ?, ?)", t.Name, t.Description, t.Content)
+	return err
+}
+
+// Projects keep their own copy of the template they were created
+// with, so updating a template only affects jobs created afterwards
+func (s *SqlStore) UpdateTemplate(updated JenkinsTemplate) error {
+	if err := ValidateTemplate(updated); err != nil {
+		return err
+	}
+	res, err := s.db.Exec("UPDATE templates SET description = ?, content = ? WHERE name = ?", updated.Description, updated.Content, updated.Name)
+	return checkAffected(res, err, fmt.Errorf("Could not find template '%s'", updated.Name))
+}
+
+func (s *SqlStore) DeleteTemplate(templateName string) error {
+	res, err := s.db.Exec("DELETE FROM templates WHERE name = ?", templateName)
+	return checkAffected(res, err, fmt.Errorf("Could not find template '%s'", templateName))
+}
+
+/* --------------------------------------------------*/
+
+// Config values
+
+func (s *SqlStore) GetConfigValues(environmentId, projectId uint) (map[string]string, error) {
+	rows, err := s.db.Query("SELECT name, value FROM config_values WHERE environment_id = ? AND project_id = ?", environmentId, projectId)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading config values: %s", err.Error())
+	}
+	defer rows.Close()
+
+	values := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, fmt.Errorf("Error reading config value: %s", err.Error())
+		}
+		values[name] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading config values: %s", err.Error())
+	}
+	return values, nil
+}
+
+// Replaces all values held for the environment/project pair
+func (s *SqlStore) SetConfigValues(environmentId, projectId uint, values map[string]string) error {
+	if err := ValidateConfigValues(values); err != nil {
+		return err
+	}
+
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := getSqlEnvironmentById(tx, environmentId); err != nil {
+			return err
+		}
+		if projectId != 0 {
+			var n int
+			tx.QueryRow("SELECT COUNT(*) FROM projects WHERE id = ?", projectId).Scan(&n)
+			if n == 0 {
+				return fmt.Errorf("Unable to find project with id: %d", projectId)
+			}
+		}
+
+		if _, err := tx.Exec("DELETE FROM config_values WHERE environment_id = ? AND project_id = ?", environmentId, projectId); err != nil {
+			return err
+		}
+		for name, value := range values {
+			_, err := tx.Exec("INSERT INTO config_values (environment_id, project_id, name, value) VALUES (?, ?, ?, ?)",
+				environmentId, projectId, name, value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SqlStore) DeleteConfigValues(environmentId, projectId uint) error {
+	_, err := s.db.Exec("DELETE FROM config_values WHERE environment_id = ? AND project_id = ?", environmentId, projectId)
+	return err
+}
+
+/* --------------------------------------------------*/
+
+// Revisions
+
+const revisionColumns = "revision, environment_id, project_id, image, tag, digest, build_number, port, environment_vars, triggered_by, timestamp, rollback_of"
+
+func scanRevision(row scanner, r *Revision) error {
+	var vars string
+	err := row.Scan(&r.Revision, &r.EnvironmentId, &r.ProjectId, &r.Image, &r.Tag, &r.Digest, &r.BuildNumber, &r.Port,
+		&vars, &r.TriggeredBy, &r.Timestamp, &r.RollbackOf)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(vars), &r.EnvironmentVars)
+}
+
+func insertSqlRevision(q querier, r Revision) error {
+	vars, err := json.Marshal(r.EnvironmentVars)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("INSERT INTO revisions ("+revisionColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		r.Revision, r.EnvironmentId, r.ProjectId, r.Image, r.Tag, r.Digest, r.BuildNumber, r.Port,
+		string(vars), r.TriggeredBy, r.Timestamp, r.RollbackOf)
+	return err
+}
+
+func (s *SqlStore) GetRevisions(environmentId, projectId uint) ([]Revision, error) {
+	rows, err := s.db.Query("SELECT "+revisionColumns+" FROM revisions WHERE environment_id = ? AND project_id = ? ORDER BY revision",
+		environmentId, projectId)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading revisions: %s", err.Error())
+	}
+	defer rows.Close()
+
+	revisions := make([]Revision, 0, 5)
+	for rows.Next() {
+		var r Revision
+		if err := scanRevision(rows, &r); err != nil {
+			return nil, fmt.Errorf("Error reading revision: %s", err.Error())
+		}
+		revisions = append(revisions, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading revisions: %s", err.Error())
+	}
+	return revisions, nil
+}
+
+func (s *SqlStore) GetRevision(environmentId, projectId, revision uint) (Revision, error) {
+	var r Revision
+	err := scanRevision(s.db.QueryRow("SELECT "+revisionColumns+" FROM revisions WHERE environment_id = ? AND project_id = ? AND revision = ?",
+		environmentId, projectId, revision), &r)
+	if err == sql.ErrNoRows {
+		return Revision{}, fmt.Errorf("Unable to find revision %d of project %d in environment %d", revision, projectId, environmentId)
+	}
+	return r, err
+}
+
+func (s *SqlStore) AddRevision(revision Revision) (Revision, error) {
+	err := s.inTx(func(tx *sql.Tx) error {
+		if _, err := getSqlEnvironmentById(tx, revision.EnvironmentId); err != nil {
+			return err
+		}
+		var n int
+		tx.QueryRow("SELECT COUNT(*) FROM projects WHERE id = ?", revision.ProjectId).Scan(&n)
+		if n == 0 {
+			return fmt.Errorf("Unable to find project with id: %d", revision.ProjectId)
+		}
+
+		err := tx.QueryRow("SELECT COALESCE(MAX(revision), 0) + 1 FROM revisions WHERE environment_id = ? AND project_id = ?",
+			revision.EnvironmentId, revision.ProjectId).Scan(&revision.Revision)
+		if err != nil {
+			return err
+		}
+		return insertSqlRevision(tx, revision)
+	})
+	if err != nil {
+		return Revision{}, err
+	}
+	return revision, nil
+}
+
+// Hands out ids from the sequence named after table, following
+// the same rules as the in-memory store
+func assignSqlId(tx *sql.Tx, table string, requested uint) (uint, error) {
+	var seq uint
+	if err := tx.QueryRow("SELECT value FROM sequences WHERE name = ?", table).Scan(&seq); err != nil {
+		return 0, err
+	}
+
+	id, err := assignId(requested, &seq, func(id uint) bool {
+		var n int
+		tx.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE id = ?", id).Scan(&n)
+		return n > 0
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec("UPDATE sequences SET value = ? WHERE name = ?", seq, table)
+	return id, err
+}
+
+// returns notFound if the statement succeeded but changed nothing
+func checkAffected(res sql.Result, err error, notFound error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound
+	}
+	return nil
+}
+
+/* --------------------------------------------------*/
+
+// Migration from the JSON file store
+
+const jsonImportMigration = "import-json"
+
+// Whether dir has JSON files that haven't been imported yet
+func (s *SqlStore) JsonImportPending(dir string) (bool, error) {
+	done, err := s.migrated(jsonImportMigration)
+	if err != nil || done {
+		return false, err
+	}
+	_, err = os.Stat(filepath.Join(dir, "config.json"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Imports the JSON files in dir into the database. This only ever
+// happens once, so it's safe to call on every startup.
+func (s *SqlStore) ImportJson(dir string) error {
+	pending, err := s.JsonImportPending(dir)
+	if err != nil || !pending {
+		return err
+	}
+
+	js, err := Open(dir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Importing config data from %s\n", dir)
+	for _, warning := range js.Warnings() {
+		fmt.Fprintf(os.Stderr, "Not importing: %s\n", warning)
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		if err := saveSqlConfig(tx, js.config); err != nil {
+			return err
+		}
+		for _, t := range js.templates {
+			if err := insertSqlTemplate(tx, t); err != nil {
+				return fmt.Errorf("Error importing template '%s': %s", t.Name, err.Error())
+			}
+		}
+		for _, e := range js.environments {
+			if err := insertSqlEnvironment(tx, e); err != nil {
+				return fmt.Errorf("Error importing environment '%s': %s", e.Name, err.Error())
+			}
+		}
+		for _, p := range js.projects {
+			if err := insertSqlProject(tx, p); err != nil {
+				return fmt.Errorf("Error importing project '%s': %s", p.ShortName, err.Error())
+			}
+		}
+		// ports are kept as-is, they're already in use
+		for _, d := range js.deployments {
+			join := DeploymentJoin{d.Environment.Id, d.Project.Id, d.Port, d.Stopped}
+			if err := insertSqlDeployment(tx, join); err != nil {
+				return fmt.Errorf("Error importing deployment of '%s': %s", d.Project.ShortName, err.Error())
+			}
+		}
+
+		for _, cv := range js.configValues {
+			for name, value := range cv.Values {
+				_, err := tx.Exec("INSERT INTO config_values (environment_id, project_id, name, value) VALUES (?, ?, ?, ?)",
+					cv.EnvironmentId, cv.ProjectId, name, value)
+				if err != nil {
+					return fmt.Errorf("Error importing config value '%s': %s", name, err.Error())
+				}
+			}
+		}
+
+		for _, r := range js.revisions {
+			if err := insertSqlRevision(tx, r); err != nil {
+				return fmt.Errorf("Error importing revision %d: %s", r.Revision, err.Error())
+			}
+		}
+
+		seq := js.sequences
+		if _, err := tx.Exec("UPDATE sequences SET value = MAX(value, ?) WHERE name = 'projects'", seq.Projects); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE sequences SET value = MAX(value, ?) WHERE name = 'environments'", seq.Environments); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec("INSERT INTO migrations (name) VALUES (?)", jsonImportMigration)
+		return err
+	})
+}
@@ -0,0 +1,120 @@
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSqlStoreImportJson(t *testing.T) {
+	dir := t.TempDir()
+	js, err := Open(filepath.Join(dir, "config"))
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	want := fillStore(t, js)
+
+	s, err := OpenSqlStore(filepath.Join(dir, "goobernet.db"))
+	if err != nil {
+		t.Fatalf("OpenSqlStore: %s", err)
+	}
+	defer s.Close()
+	if err := s.ImportJson(filepath.Join(dir, "config")); err != nil {
+		t.Fatalf("ImportJson: %s", err)
+	}
+	// only ever imports once
+	if err := s.ImportJson(filepath.Join(dir, "config")); err != nil {
+		t.Fatalf("second ImportJson: %s", err)
+	}
+	checkContents(t, s, want)
+	checkNextProjectId(t, s, want)
+}
+
+func TestSqlStoreReadErrors(t *testing.T) {
+	s, err := OpenSqlStore(filepath.Join(t.TempDir(), "goobernet.db"))
+	if err != nil {
+		t.Fatalf("OpenSqlStore: %s", err)
+	}
+	defer s.Close()
+
+	e := mustAddEnvironment(t, s, "dev", "localhost", 8000)
+	good := mustAddProject(t, s, "good")
+	bad := mustAddProject(t, s, "bad")
+	mustAddDeployment(t, s, e, good)
+	mustAddDeployment(t, s, e, bad)
+	if _, err := s.db.Exec("UPDATE projects SET health_check = 'not json' WHERE id = ?", bad.Id); err != nil {
+		t.Fatalf("breaking project: %s", err)
+	}
+
+	// an unreadable row fails the whole read, rather than being left out
+	if projects, err := s.GetProjects(); err == nil {
+		t.Errorf("GetProjects = %+v, want an error", projects)
+	}
+	if deployments, err := s.GetDeployments(); err == nil {
+		t.Errorf("GetDeployments = %+v, want an error", deployments)
+	}
+	if urls, err := s.GetDeploymentsByEnvironmentId(e.Id); err == nil {
+		t.Errorf("GetDeploymentsByEnvironmentId = %v, want an error", urls)
+	}
+
+	s.Close()
+	if _, err := s.GetEnvironments(); err == nil {
+		t.Errorf("GetEnvironments on a closed database succeeded")
+	}
+	if _, err := s.GetConfig(); err == nil {
+		t.Errorf("GetConfig on a closed database succeeded")
+	}
+}
+
+func TestSqlStoreOpenReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "goobernet.db")
+	if _, err := OpenSqlStoreReadOnly(path); err == nil {
+		t.Errorf("OpenSqlStoreReadOnly of a missing database succeeded")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("OpenSqlStoreReadOnly created %s", path)
+	}
+
+	s, err := OpenSqlStore(path)
+	if err != nil {
+		t.Fatalf("OpenSqlStore: %s", err)
+	}
+	mustAddProject(t, s, "billing")
+	s.Close()
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+
+	ro, err := OpenSqlStoreReadOnly(path)
+	if err != nil {
+		t.Fatalf("OpenSqlStoreReadOnly: %s", err)
+	}
+	if got, err := ro.GetProjects(); err != nil || len(got) != 1 {
+		t.Errorf("GetProjects = %+v, %v; want billing", got, err)
+	}
+	if _, err := ro.AddProject(Project{Name: "ledger", ShortName: "ledger"}); err == nil {
+		t.Errorf("AddProject on a read only database succeeded")
+	}
+	ro.Close()
+	if after, _ := ioutil.ReadFile(path); string(after) != string(before) {
+		t.Errorf("OpenSqlStoreReadOnly changed the database")
+	}
+
+	// a database from before the latest migration isn't migrated
+	s, err = OpenSqlStore(path)
+	if err != nil {
+		t.Fatalf("OpenSqlStore: %s", err)
+	}
+	last := schemaMigrations[len(schemaMigrations)-1].name
+	if _, err := s.db.Exec("DELETE FROM migrations WHERE name = ?", last); err != nil {
+		t.Fatalf("forgetting migration: %s", err)
+	}
+	s.Close()
+	if ro, err := OpenSqlStoreReadOnly(path); err == nil {
+		ro.Close()
+		t.Errorf("OpenSqlStoreReadOnly of an unmigrated database succeeded")
+	}
+}
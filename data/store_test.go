@@ -0,0 +1,602 @@
+package data
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Opens a store in dir. Opening the same dir again gives back what the
+// first store saved, except for the memory store, which can't reopen.
+type storeOpener struct {
+	name    string
+	open    func(t *testing.T, dir string) Store
+	reopens bool
+	close   func(s Store)
+}
+
+var storeOpeners = []storeOpener{
+	{
+		name: "memory",
+		open: func(t *testing.T, dir string) Store {
+			return NewMemoryStore(DefaultConfig())
+		},
+	},
+	{
+		name: "json",
+		open: func(t *testing.T, dir string) Store {
+			s, err := Open(filepath.Join(dir, "config"))
+			if err != nil {
+				t.Fatalf("Open: %s", err)
+			}
+			return s
+		},
+		reopens: true,
+	},
+	{
+		name: "sqlite",
+		open: func(t *testing.T, dir string) Store {
+			s, err := OpenSqlStore(filepath.Join(dir, "goobernet.db"))
+			if err != nil {
+				t.Fatalf("OpenSqlStore: %s", err)
+			}
+			return s
+		},
+		reopens: true,
+		close: func(s Store) {
+			s.(*SqlStore).Close()
+		},
+	},
+}
+
+// Runs test against a fresh store of every kind
+func forEachStore(t *testing.T, test func(t *testing.T, s Store)) {
+	for _, o := range storeOpeners {
+		o := o
+		t.Run(o.name, func(t *testing.T) {
+			s := o.open(t, t.TempDir())
+			if o.close != nil {
+				defer o.close(s)
+			}
+			test(t, s)
+		})
+	}
+}
+
+func mustAddEnvironment(t *testing.T, s Store, name, hostname string, startingPort uint) Environment {
+	t.Helper()
+	e, err := s.AddEnvironment(Environment{Name: name, Hostname: hostname, StartingPort: startingPort, Registry: "registry:5000"})
+	if err != nil {
+		t.Fatalf("AddEnvironment(%s): %s", name, err)
+	}
+	return e
+}
+
+func mustAddProject(t *testing.T, s Store, shortName string) Project {
+	t.Helper()
+	p, err := s.AddProject(Project{Name: shortName + " service", ShortName: shortName})
+	if err != nil {
+		t.Fatalf("AddProject(%s): %s", shortName, err)
+	}
+	return p
+}
+
+func mustAddDeployment(t *testing.T, s Store, e Environment, p Project) Deployment {
+	t.Helper()
+	d, err := s.AddDeployment(e.Id, p.Id)
+	if err != nil {
+		t.Fatalf("AddDeployment(%s, %s): %s", e.Name, p.ShortName, err)
+	}
+	return d
+}
+
+func TestStoreIds(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		a := mustAddProject(t, s, "a")
+		b := mustAddProject(t, s, "b")
+		if a.Id != 1 || b.Id != 2 {
+			t.Fatalf("got ids %d and %d, want 1 and 2", a.Id, b.Id)
+		}
+
+		if err := s.DeleteProject(b.Id); err != nil {
+			t.Fatalf("DeleteProject: %s", err)
+		}
+		if c := mustAddProject(t, s, "c"); c.Id != 3 {
+			t.Errorf("id after a delete = %d, want 3 as ids aren't reused", c.Id)
+		}
+
+		kept, err := s.AddProject(Project{Id: 10, Name: "d", ShortName: "d"})
+		if err != nil || kept.Id != 10 {
+			t.Errorf("AddProject with id 10 = %d, %v; want the id kept", kept.Id, err)
+		}
+		if _, err := s.AddProject(Project{Id: 10, Name: "e", ShortName: "e"}); err == nil {
+			t.Errorf("AddProject with a taken id succeeded")
+		}
+		if e := mustAddProject(t, s, "f"); e.Id != 11 {
+			t.Errorf("id after an explicit 10 = %d, want 11", e.Id)
+		}
+	})
+}
+
+func TestStoreDuplicates(t *testing.T) {
+	tests := []struct {
+		name string
+		add  func(s Store) error
+	}{
+		{"project short name", func(s Store) error {
+			_, err := s.AddProject(Project{Name: "Other", ShortName: "Billing"})
+			return err
+		}},
+		{"environment name", func(s Store) error {
+			_, err := s.AddEnvironment(Environment{Name: "dev", Hostname: "other", StartingPort: 9000, Registry: "r"})
+			return err
+		}},
+		{"deployment", func(s Store) error {
+			e, _ := s.GetEnvironmentByName("dev")
+			p, _ := s.GetProjectByShortName("billing")
+			_, err := s.AddDeployment(e.Id, p.Id)
+			return err
+		}},
+		{"template", func(s Store) error {
+			return s.AddTemplate(JenkinsTemplate{Name: "go", Content: "<project/>"})
+		}},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, s Store) {
+				e := mustAddEnvironment(t, s, "dev", "localhost", 8000)
+				p := mustAddProject(t, s, "billing")
+				mustAddDeployment(t, s, e, p)
+				if err := s.AddTemplate(JenkinsTemplate{Name: "go", Content: "<project/>"}); err != nil {
+					t.Fatalf("AddTemplate: %s", err)
+				}
+
+				if err := test.add(s); err == nil {
+					t.Errorf("adding a duplicate %s succeeded", test.name)
+				}
+			})
+		})
+	}
+}
+
+func TestStorePorts(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		dev := mustAddEnvironment(t, s, "dev", "localhost", 8000)
+		// shares dev's host, so competes for the same ports
+		test := mustAddEnvironment(t, s, "test", "localhost", 8000)
+		prod := mustAddEnvironment(t, s, "prod", "prod-host", 8000)
+		a := mustAddProject(t, s, "a")
+		b := mustAddProject(t, s, "b")
+
+		ports := []struct {
+			environment Environment
+			project     Project
+			want        uint
+		}{
+			{dev, a, 8000},
+			{dev, b, 8001},
+			{test, a, 8002},
+			{prod, a, 8000},
+		}
+		for _, p := range ports {
+			if d := mustAddDeployment(t, s, p.environment, p.project); d.Port != p.want {
+				t.Errorf("%s in %s got port %d, want %d", p.project.ShortName, p.environment.Name, d.Port, p.want)
+			}
+		}
+
+		if _, err := s.SetDeploymentPort(dev.Id, a.Id, 8001); err == nil {
+			t.Errorf("moving to a port in use on the host succeeded")
+		}
+		moved, err := s.SetDeploymentPort(dev.Id, a.Id, 8100)
+		if err != nil || moved.Port != 8100 {
+			t.Fatalf("SetDeploymentPort = %d, %v; want 8100", moved.Port, err)
+		}
+		if d, _ := s.GetDeployment(dev.Id, a.Id); d.Port != 8100 {
+			t.Errorf("port after moving = %d, want 8100", d.Port)
+		}
+
+		// 8000 was freed by the move
+		if err := s.DeleteDeployment(test.Id, a.Id); err != nil {
+			t.Fatalf("DeleteDeployment: %s", err)
+		}
+		if d := mustAddDeployment(t, s, test, b); d.Port != 8000 {
+			t.Errorf("port after freeing 8000 = %d, want 8000", d.Port)
+		}
+	})
+}
+
+func TestStoreDeployments(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		e := mustAddEnvironment(t, s, "dev", "localhost", 8000)
+		p, err := s.AddProject(Project{
+			Name:        "Billing",
+			ShortName:   "billing",
+			HealthCheck: HealthCheck{Type: HEALTH_HTTP, Path: "/health", Interval: 10, UnhealthyThreshold: 2},
+		})
+		if err != nil {
+			t.Fatalf("AddProject: %s", err)
+		}
+		other := mustAddProject(t, s, "ledger")
+		mustAddDeployment(t, s, e, p)
+		mustAddDeployment(t, s, e, other)
+
+		d, err := s.GetDeployment(e.Id, p.Id)
+		if err != nil {
+			t.Fatalf("GetDeployment: %s", err)
+		}
+		if !reflect.DeepEqual(d.Project, p) || !reflect.DeepEqual(d.Environment, e) {
+			t.Errorf("GetDeployment = %+v, want project %+v in %+v", d, p, e)
+		}
+		if all, err := s.GetDeployments(); err != nil || len(all) != 2 {
+			t.Errorf("GetDeployments returned %d deployments, %v; want 2", len(all), err)
+		}
+
+		urls, err := s.GetDeploymentsByEnvironmentName("dev")
+		want := map[string]string{"billing": "localhost:8000", "ledger": "localhost:8001"}
+		if err != nil || !reflect.DeepEqual(urls, want) {
+			t.Errorf("GetDeploymentsByEnvironmentName = %v, %v; want %v", urls, err, want)
+		}
+
+		// deployments see changes to their project
+		p.Description = "Sends the bills"
+		if err := s.UpdateProject(p); err != nil {
+			t.Fatalf("UpdateProject: %s", err)
+		}
+		if d, _ := s.GetDeployment(e.Id, p.Id); d.Project.Description != p.Description {
+			t.Errorf("deployment's project description = '%s', want '%s'", d.Project.Description, p.Description)
+		}
+
+		if err := s.SetDeploymentStopped(e.Id, p.Id, true); err != nil {
+			t.Fatalf("SetDeploymentStopped: %s", err)
+		}
+		if d, _ := s.GetDeployment(e.Id, p.Id); !d.Stopped {
+			t.Errorf("deployment isn't stopped after SetDeploymentStopped")
+		}
+		if d, _ := s.GetDeployment(e.Id, other.Id); d.Stopped {
+			t.Errorf("stopping one deployment stopped another")
+		}
+		if err := s.SetDeploymentStopped(e.Id, 99, true); err == nil {
+			t.Errorf("SetDeploymentStopped of a project that isn't deployed succeeded")
+		}
+
+		if err := s.DeleteProject(p.Id); err == nil {
+			t.Errorf("deleting a deployed project succeeded")
+		}
+		if err := s.DeleteEnvironment(e.Id); err == nil {
+			t.Errorf("deleting an environment with deployments succeeded")
+		}
+	})
+}
+
+func TestStoreRenamesWhileDeployed(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		e := mustAddEnvironment(t, s, "dev", "localhost", 8000)
+		p := mustAddProject(t, s, "billing")
+		mustAddDeployment(t, s, e, p)
+
+		renamed := p
+		renamed.ShortName = "invoicing"
+		if err := s.UpdateProject(renamed); err == nil {
+			t.Errorf("renaming a deployed project succeeded")
+		}
+		renamedEnv := e
+		renamedEnv.Name = "development"
+		if err := s.UpdateEnvironment(renamedEnv); err == nil {
+			t.Errorf("renaming an environment with deployments succeeded")
+		}
+
+		if err := s.DeleteDeployment(e.Id, p.Id); err != nil {
+			t.Fatalf("DeleteDeployment: %s", err)
+		}
+		if err := s.UpdateProject(renamed); err != nil {
+			t.Errorf("renaming an undeployed project: %s", err)
+		}
+		if err := s.UpdateEnvironment(renamedEnv); err != nil {
+			t.Errorf("renaming an environment without deployments: %s", err)
+		}
+	})
+}
+
+func TestStoreConfigValues(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		e := mustAddEnvironment(t, s, "dev", "localhost", 8000)
+		p := mustAddProject(t, s, "billing")
+
+		defaults := map[string]string{"LOG_LEVEL": "info", "DB_HOST": "db"}
+		overrides := map[string]string{"LOG_LEVEL": "debug"}
+		if err := s.SetConfigValues(e.Id, 0, defaults); err != nil {
+			t.Fatalf("SetConfigValues defaults: %s", err)
+		}
+		if err := s.SetConfigValues(e.Id, p.Id, overrides); err != nil {
+			t.Fatalf("SetConfigValues overrides: %s", err)
+		}
+		if err := s.SetConfigValues(e.Id, p.Id, map[string]string{"NOT-VALID": "x"}); err == nil {
+			t.Errorf("SetConfigValues with an invalid name succeeded")
+		}
+
+		if got, err := s.GetConfigValues(e.Id, 0); err != nil || !reflect.DeepEqual(got, defaults) {
+			t.Errorf("defaults = %v, %v; want %v", got, err, defaults)
+		}
+		if got, err := s.GetConfigValues(e.Id, p.Id); err != nil || !reflect.DeepEqual(got, overrides) {
+			t.Errorf("overrides = %v, %v; want %v", got, err, overrides)
+		}
+
+		// callers get copies
+		got, _ := s.GetConfigValues(e.Id, 0)
+		got["LOG_LEVEL"] = "changed"
+		if got, _ := s.GetConfigValues(e.Id, 0); got["LOG_LEVEL"] != "info" {
+			t.Errorf("changing returned values reached the store, LOG_LEVEL = '%s'", got["LOG_LEVEL"])
+		}
+
+		if err := s.DeleteConfigValues(e.Id, p.Id); err != nil {
+			t.Fatalf("DeleteConfigValues: %s", err)
+		}
+		if got, err := s.GetConfigValues(e.Id, p.Id); err != nil || len(got) != 0 {
+			t.Errorf("overrides after delete = %v, %v; want none", got, err)
+		}
+	})
+}
+
+func TestStoreRevisions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		e := mustAddEnvironment(t, s, "dev", "localhost", 8000)
+		a := mustAddProject(t, s, "a")
+		b := mustAddProject(t, s, "b")
+
+		add := func(p Project, tag string) Revision {
+			t.Helper()
+			r, err := s.AddRevision(Revision{
+				EnvironmentId:   e.Id,
+				ProjectId:       p.Id,
+				Image:           "registry:5000/" + p.ShortName,
+				Tag:             tag,
+				Port:            8000,
+				EnvironmentVars: map[string]string{"PORT": "8000"},
+				TriggeredBy:     "tester",
+				Timestamp:       time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			})
+			if err != nil {
+				t.Fatalf("AddRevision: %s", err)
+			}
+			return r
+		}
+
+		// numbered per environment/project pair
+		if r := add(a, "1"); r.Revision != 1 {
+			t.Errorf("first revision of a = %d, want 1", r.Revision)
+		}
+		if r := add(b, "1"); r.Revision != 1 {
+			t.Errorf("first revision of b = %d, want 1", r.Revision)
+		}
+		if r := add(a, "2"); r.Revision != 2 {
+			t.Errorf("second revision of a = %d, want 2", r.Revision)
+		}
+
+		revisions, err := s.GetRevisions(e.Id, a.Id)
+		if err != nil {
+			t.Fatalf("GetRevisions: %s", err)
+		}
+		if len(revisions) != 2 || revisions[0].Tag != "1" || revisions[1].Tag != "2" {
+			t.Fatalf("GetRevisions = %+v, want tags 1 then 2", revisions)
+		}
+		r, err := s.GetRevision(e.Id, a.Id, 2)
+		if err != nil {
+			t.Fatalf("GetRevision: %s", err)
+		}
+		if r.EnvironmentVars["PORT"] != "8000" || !r.Timestamp.Equal(revisions[1].Timestamp) {
+			t.Errorf("GetRevision = %+v, want it to match %+v", r, revisions[1])
+		}
+		if _, err := s.GetRevision(e.Id, a.Id, 3); err == nil {
+			t.Errorf("GetRevision of a revision that doesn't exist succeeded")
+		}
+		if _, err := s.AddRevision(Revision{EnvironmentId: e.Id, ProjectId: 99}); err == nil {
+			t.Errorf("AddRevision for an unknown project succeeded")
+		}
+
+		if err := s.DeleteProject(a.Id); err != nil {
+			t.Fatalf("DeleteProject: %s", err)
+		}
+		if got, err := s.GetRevisions(e.Id, a.Id); err != nil || len(got) != 0 {
+			t.Errorf("revisions of a deleted project = %+v, %v; want none", got, err)
+		}
+		if got, err := s.GetRevisions(e.Id, b.Id); err != nil || len(got) != 1 {
+			t.Errorf("revisions of b after deleting a = %d, %v; want 1", len(got), err)
+		}
+	})
+}
+
+func TestStoreConcurrentUse(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		e := mustAddEnvironment(t, s, "dev", "localhost", 8000)
+
+		// each goroutine adds and deploys its own project while the
+		// others read, so run with -race to catch unguarded access
+		const workers = 8
+		errs := make(chan error, workers)
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				shortName := fmt.Sprintf("p%d", i)
+				p, err := s.AddProject(Project{Name: shortName, ShortName: shortName})
+				if err == nil {
+					_, err = s.AddDeployment(e.Id, p.Id)
+				}
+				if err == nil {
+					err = s.SetConfigValues(e.Id, p.Id, map[string]string{"WORKER": shortName})
+				}
+				for j := 0; err == nil && j < 10; j++ {
+					if _, err = s.GetDeployments(); err == nil {
+						_, err = s.GetDeploymentsByEnvironmentId(e.Id)
+					}
+				}
+				errs <- err
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Errorf("concurrent use: %s", err)
+			}
+		}
+
+		// nothing was lost or handed out twice
+		deployments, _ := s.GetDeployments()
+		if len(deployments) != workers {
+			t.Fatalf("%d deployments, want %d", len(deployments), workers)
+		}
+		ids, ports := map[uint]bool{}, map[uint]bool{}
+		for _, d := range deployments {
+			ids[d.Project.Id], ports[d.Port] = true, true
+		}
+		if len(ids) != workers || len(ports) != workers {
+			t.Errorf("deployments share project ids or ports: %+v", deployments)
+		}
+	})
+}
+
+// Everything the round trip tests save, and check comes back
+type storeContents struct {
+	config       GoobernetConfig
+	environment  Environment
+	project      Project
+	deployment   Deployment
+	template     JenkinsTemplate
+	configValues map[string]string
+	revision     Revision
+}
+
+func fillStore(t *testing.T, s Store) storeContents {
+	t.Helper()
+	var c storeContents
+
+	c.config = GoobernetConfig{
+		JenkinsUrl:      "http://jenkins:8080",
+		JenkinsUsername: "admin",
+		JenkinsPassword: "hunter2",
+		Registry:        "registry:5000",
+		RegistryAuth:    []RegistryAuth{{"registry:5000", "deployer", "s3cret"}},
+	}
+	if err := s.SaveConfig(c.config); err != nil {
+		t.Fatalf("SaveConfig: %s", err)
+	}
+
+	c.template = JenkinsTemplate{Name: "go", Description: "Go services", Content: "<project>{{.Name}}</project>"}
+	if err := s.AddTemplate(c.template); err != nil {
+		t.Fatalf("AddTemplate: %s", err)
+	}
+
+	c.environment = mustAddEnvironment(t, s, "dev", "localhost", 8000)
+	var err error
+	c.project, err = s.AddProject(Project{
+		Name:          "Billing",
+		ShortName:     "billing",
+		Email:         "billing@example.com",
+		BuildTemplate: JenkinsTemplate{Name: "go"},
+		HealthCheck:   HealthCheck{Type: HEALTH_COMMAND, Command: []string{"pg_isready", "-q"}, Timeout: 2},
+	})
+	if err != nil {
+		t.Fatalf("AddProject: %s", err)
+	}
+	c.deployment = mustAddDeployment(t, s, c.environment, c.project)
+	if err := s.SetDeploymentStopped(c.environment.Id, c.project.Id, true); err != nil {
+		t.Fatalf("SetDeploymentStopped: %s", err)
+	}
+	c.deployment.Stopped = true
+
+	c.configValues = map[string]string{"DB_HOST": "db"}
+	if err := s.SetConfigValues(c.environment.Id, c.project.Id, c.configValues); err != nil {
+		t.Fatalf("SetConfigValues: %s", err)
+	}
+
+	c.revision, err = s.AddRevision(Revision{
+		EnvironmentId:   c.environment.Id,
+		ProjectId:       c.project.Id,
+		Image:           "registry:5000/billing",
+		Tag:             "42",
+		Digest:          "sha256:abc",
+		BuildNumber:     42,
+		Port:            c.deployment.Port,
+		EnvironmentVars: map[string]string{"DB_HOST": "db", "PORT": "8000"},
+		TriggeredBy:     "tester",
+		Timestamp:       time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatalf("AddRevision: %s", err)
+	}
+	return c
+}
+
+func checkContents(t *testing.T, s Store, want storeContents) {
+	t.Helper()
+	if got, err := s.GetConfig(); err != nil || !reflect.DeepEqual(got, want.config) {
+		t.Errorf("config = %#v, %v; want %#v", got, err, want.config)
+	}
+	if got, err := s.GetTemplateByName(want.template.Name); err != nil || !reflect.DeepEqual(*got, want.template) {
+		t.Errorf("template = %+v, %v; want %+v", got, err, want.template)
+	}
+	if got, err := s.GetEnvironmentById(want.environment.Id); err != nil || got != want.environment {
+		t.Errorf("environment = %+v, %v; want %+v", got, err, want.environment)
+	}
+	if got, err := s.GetProjectById(want.project.Id); err != nil || !reflect.DeepEqual(got, want.project) {
+		t.Errorf("project = %+v, %v; want %+v", got, err, want.project)
+	}
+	if got, err := s.GetDeployment(want.environment.Id, want.project.Id); err != nil || !reflect.DeepEqual(got, want.deployment) {
+		t.Errorf("deployment = %+v, %v; want %+v", got, err, want.deployment)
+	}
+	if got, err := s.GetConfigValues(want.environment.Id, want.project.Id); err != nil || !reflect.DeepEqual(got, want.configValues) {
+		t.Errorf("config values = %v, %v; want %v", got, err, want.configValues)
+	}
+	got, err := s.GetRevision(want.environment.Id, want.project.Id, want.revision.Revision)
+	if err != nil {
+		t.Errorf("GetRevision: %s", err)
+	} else {
+		if !got.Timestamp.Equal(want.revision.Timestamp) {
+			t.Errorf("revision timestamp = %s, want %s", got.Timestamp, want.revision.Timestamp)
+		}
+		got.Timestamp = want.revision.Timestamp
+		if !reflect.DeepEqual(got, want.revision) {
+			t.Errorf("revision = %+v, want %+v", got, want.revision)
+		}
+	}
+}
+
+// ids carry on from where they were
+func checkNextProjectId(t *testing.T, s Store, want storeContents) {
+	t.Helper()
+	if p := mustAddProject(t, s, "ledger"); p.Id != want.project.Id+1 {
+		t.Errorf("next project id = %d, want %d", p.Id, want.project.Id+1)
+	}
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	for _, o := range storeOpeners {
+		if !o.reopens {
+			continue
+		}
+		o := o
+		t.Run(o.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := o.open(t, dir)
+			want := fillStore(t, s)
+			checkContents(t, s, want)
+			if o.close != nil {
+				o.close(s)
+			}
+
+			reopened := o.open(t, dir)
+			if o.close != nil {
+				defer o.close(reopened)
+			}
+			checkContents(t, reopened, want)
+			checkNextProjectId(t, reopened, want)
+		})
+	}
+}
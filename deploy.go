@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/travissimon/goobernet/data"
+	"github.com/travissimon/goobernet/docker"
+)
+
+const DEPLOY_SEGMENT = "deploy"
+
+// Held while containers are being changed, so that deploys and the
+// reconciler don't act on each other's half finished work
+var deployLock sync.Mutex
+
+type deployResponse struct {
+	deploymentResponse
+	Image       string   `json:"image"`
+	ContainerId string   `json:"containerId"`
+	Status      string   `json:"status"`
+	Revision    uint     `json:"revision,omitempty"`
+	Pull        []string `json:"pull,omitempty"`
+	// what went wrong after the deploy succeeded, such as failing to
+	// record it in the history
+	Warnings []string `json:"warnings,omitempty"`
+	// the config values the container was given, nil for the stored ones
+	values map[string]string
+}
+
+// handles requests for /v1/environments/(environment-name)/deploy/(project-short-name)
+// ?dryRun=true returns the plan instead of carrying it out
+func deployHandler(environmentName, projectShortName string, w http.ResponseWriter, r *http.Request) {
+	environment, err := store.GetEnvironmentByName(environmentName)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+	project, err := store.GetProjectByShortName(projectShortName)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	switch {
+	case r.Method == "POST" && dryRun:
+		handlePlanDeploy(environment, project, w, r)
+	case r.Method == "POST":
+		handleDeploy(environment, project, w, r)
+	case r.Method == "DELETE" && dryRun:
+		handlePlanUndeploy(environment, project, w)
+	case r.Method == "DELETE":
+		handleUndeploy(environment, project, w)
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+// ?tag= picks the image tag or digest, or ?build= a Jenkins build
+// number; latest otherwise
+func parseTag(r *http.Request) (string, error) {
+	tag := r.URL.Query().Get("tag")
+	if build := r.URL.Query().Get("build"); build != "" {
+		if tag != "" {
+			return "", fmt.Errorf("Only one of tag and build may be given")
+		}
+		if _, err := strconv.ParseUint(build, 10, 64); err != nil {
+			return "", fmt.Errorf("'%s' is not a valid build number", build)
+		}
+		tag = build
+	}
+	if tag == "" {
+		return docker.DEFAULT_TAG, nil
+	}
+	return tag, docker.ValidateTag(tag)
+}
+
+// Records the deployment if it's new, pulls the image, then replaces
+// whatever container the deployment had with a fresh one. With
+// ?progress=true the pull progress is streamed as plain text, followed
+// by the result on the last line.
+func handleDeploy(environment data.Environment, project data.Project, w http.ResponseWriter, r *http.Request) {
+	tag, err := parseTag(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%s\n", err.Error())
+		return
+	}
+	ro, err := parseRollout(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%s\n", err.Error())
+		return
+	}
+
+	deployLock.Lock()
+	defer deployLock.Unlock()
+
+	deployment, err := store.GetDeployment(environment.Id, project.Id)
+	isNew := err != nil
+	if isNew {
+		if deployment, err = store.AddDeployment(environment.Id, project.Id); err != nil {
+			writeError(w, http.StatusConflict, "Error creating deployment: %s\n", err.Error())
+			return
+		}
+	}
+
+	var progress bytes.Buffer
+	var out io.Writer = &progress
+	streaming := r.URL.Query().Get("progress") == "true"
+	if streaming {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		out = newFlushWriter(w)
+	}
+
+	resp, err := runDeployment(deployment, tag, nil, ro, out)
+	if err != nil {
+		if isNew {
+			store.DeleteDeployment(environment.Id, project.Id)
+		}
+		msg := fmt.Sprintf("Error deploying '%s' to '%s': %s\n", project.ShortName, environment.Name, err.Error())
+		if streaming {
+			fmt.Fprint(out, msg)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "%s", msg)
+		return
+	}
+
+	recordRevision(resp, tag, triggeredBy(r), 0)
+
+	if streaming {
+		json.NewEncoder(out).Encode(resp)
+		return
+	}
+	resp.Pull = strings.Split(strings.TrimSpace(progress.String()), "\n")
+	if isNew {
+		w.WriteHeader(http.StatusCreated)
+	}
+	marshalAndWrite(resp, w)
+}
+
+// Pulls the image and runs it for the deployment with the given config
+// values, or the stored ones if values is nil
+func runDeployment(deployment data.Deployment, tag string, values map[string]string, ro rollout, progress io.Writer) (*deployResponse, error) {
+	image := deployment.Image()
+	auth := config.RegistryCredentials(deployment.Environment.Registry)
+	if err := dockerClient.PullImage(image, tag, auth, progress); err != nil {
+		return nil, err
+	}
+	var resp *deployResponse
+	var err error
+	if ro.Strategy == STRATEGY_BLUE_GREEN {
+		resp, err = blueGreenContainer(deployment, docker.ImageRef(image, tag), values, ro)
+	} else {
+		resp, err = replaceContainer(deployment, docker.ImageRef(image, tag), values)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// running again, so the reconciler looks after it again
+	if deployment.Stopped {
+		if err := store.SetDeploymentStopped(deployment.Environment.Id, deployment.Project.Id, false); err != nil {
+			fmt.Fprintf(os.Stderr, "Error marking '%s' in '%s' as running: %s\n", deployment.Project.ShortName, deployment.Environment.Name, err.Error())
+		}
+		resp.Stopped = false
+	}
+	return resp, nil
+}
+
+// Swaps the deployment's container for a new one running imageRef,
+// which must already have been pulled
+func replaceContainer(deployment data.Deployment, imageRef string, values map[string]string) (*deployResponse, error) {
+	if err := removeDeploymentContainer(deployment); err != nil {
+		return nil, err
+	}
+
+	container, err := dockerClient.CreateDeploymentContainer(store, deployment, docker.DeploymentContainerName(deployment), imageRef, values)
+	if err != nil {
+		return nil, err
+	}
+	if err := dockerClient.StartContainer(container.ID); err != nil {
+		dockerClient.RemoveContainer(container.ID, true)
+		return nil, err
+	}
+
+	status := "created"
+	if started, err := dockerClient.FindContainer(container.ID); err == nil && started != nil {
+		status = started.State.Status
+	}
+	return &deployResponse{
+		deploymentResponse: newDeploymentResponse(deployment),
+		Image:              imageRef,
+		ContainerId:        container.ID,
+		Status:             status,
+		values:             values,
+	}, nil
+}
+
+func removeDeploymentContainer(deployment data.Deployment) error {
+	existing, err := dockerClient.FindContainer(docker.DeploymentContainerName(deployment))
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return nil
+	}
+	// give the service a chance to shut down cleanly before it's killed
+	if err := dockerClient.StopContainer(existing.ID, stopTimeout); err != nil {
+		fmt.Fprintf(os.Stderr, "Error stopping container %s: %s\n", existing.ID, err.Error())
+	}
+	if err := dockerClient.RemoveContainer(existing.ID, true); err != nil {
+		return fmt.Errorf("Unable to remove existing container %s: %s", existing.ID, err.Error())
+	}
+	return nil
+}
+
+// Removes the container along with the deployment, freeing its port
+func handleUndeploy(environment data.Environment, project data.Project, w http.ResponseWriter) {
+	deployLock.Lock()
+	defer deployLock.Unlock()
+
+	deployment, err := store.GetDeployment(environment.Id, project.Id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+	if err := removeDeploymentContainer(deployment); err != nil {
+		writeError(w, http.StatusInternalServerError, "%s\n", err.Error())
+		return
+	}
+	if err := store.DeleteDeployment(environment.Id, project.Id); err != nil {
+		writeError(w, http.StatusInternalServerError, "%s\n", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
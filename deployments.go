@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/travissimon/goobernet/data"
+	"github.com/travissimon/goobernet/health"
+)
+
+const DEPLOYMENTS_PATH = "/v1/deployments/"
+
+type deploymentResponse struct {
+	data.Deployment
+	Url string `json:"url"`
+	// only for projects with a health check
+	Health *health.Status `json:"health,omitempty"`
+}
+
+func newDeploymentResponse(d data.Deployment) deploymentResponse {
+	resp := deploymentResponse{Deployment: d, Url: d.Url()}
+	if checker != nil {
+		if status, ok := checker.Status(d.Environment.Id, d.Project.Id); ok {
+			resp.Health = &status
+		}
+	}
+	return resp
+}
+
+// handles requests for /v1/deployments
+func deploymentsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		getDeploymentsHandler(w, r)
+	case "POST":
+		handlePostDeployment(w, r)
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+// handles requests for /v1/deployments/(environment-name)/(project-short-name)
+// and its /history and /rollback
+func deploymentHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path[len(DEPLOYMENTS_PATH):], "/")
+	if len(parts) != 2 && len(parts) != 3 {
+		writeError(w, http.StatusNotFound, "Expected %s(environment)/(project)[/history|rollback]\n", DEPLOYMENTS_PATH)
+		return
+	}
+
+	environment, err := store.GetEnvironmentByName(parts[0])
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+	project, err := store.GetProjectByShortName(parts[1])
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+
+	if len(parts) == 3 {
+		switch {
+		case parts[2] == "history" && r.Method == "GET":
+			handleGetHistory(environment, project, w)
+		case parts[2] == "rollback" && r.Method == "POST":
+			handleRollback(environment, project, w, r)
+		case parts[2] == "history" || parts[2] == "rollback":
+			writeMethodNotAllowed(w, r)
+		default:
+			writeError(w, http.StatusNotFound, "Unknown deployment resource '%s'\n", parts[2])
+		}
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		handleGetDeployment(environment, project, w)
+	case "DELETE":
+		handleDeleteDeployment(environment, project, w)
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+func getDeploymentsHandler(w http.ResponseWriter, r *http.Request) {
+	deployments, err := store.GetDeployments()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%s\n", err.Error())
+		return
+	}
+	resps := make([]deploymentResponse, 0, len(deployments))
+	for _, d := range deployments {
+		resps = append(resps, newDeploymentResponse(d))
+	}
+	marshalAndWrite(resps, w)
+}
+
+func handleGetDeployment(environment data.Environment, project data.Project, w http.ResponseWriter) {
+	deployment, err := store.GetDeployment(environment.Id, project.Id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+	marshalAndWrite(newDeploymentResponse(deployment), w)
+}
+
+// expects {"environmentId": n, "projectId": n}; the port is always allocated
+func handlePostDeployment(w http.ResponseWriter, r *http.Request) {
+	var join data.DeploymentJoin
+	if err := json.NewDecoder(r.Body).Decode(&join); err != nil {
+		writeError(w, http.StatusBadRequest, "Error decoding deployment json: %s\n", err.Error())
+		return
+	}
+	if _, err := store.GetEnvironmentById(join.EnvironmentId); err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+	if _, err := store.GetProjectById(join.ProjectId); err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+
+	// a blue/green deploy has a port in use that isn't recorded yet
+	deployLock.Lock()
+	deployment, err := store.AddDeployment(join.EnvironmentId, join.ProjectId)
+	deployLock.Unlock()
+	if err != nil {
+		writeError(w, http.StatusConflict, "Error creating deployment: %s\n", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	marshalAndWrite(newDeploymentResponse(deployment), w)
+}
+
+func handleDeleteDeployment(environment data.Environment, project data.Project, w http.ResponseWriter) {
+	if err := store.DeleteDeployment(environment.Id, project.Id); err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
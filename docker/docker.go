@@ -3,7 +3,9 @@ package docker
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 
 	docker "github.com/fsouza/go-dockerclient"
 	"github.com/travissimon/goobernet/data"
@@ -19,7 +21,41 @@ type Container struct {
 	Labels     []Label `json:"labels"`
 	RootFsSize int64   `json:"rootFsSize"`
 	RwSize     int64   `json:"sizeRw"`
+	State      string  `json:"state"`
 	Status     string  `json:"status"`
+	// filled in by goobernet for deployments with a health check
+	Health string `json:"health,omitempty"`
+}
+
+// The value of the named label, or "" if the container doesn't have it
+func (c Container) Label(name string) string {
+	for _, l := range c.Labels {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// The service variables the container was started with. Containers
+// created before they were labelled have none.
+func (c Container) ServiceVars() map[string]string {
+	vars := make(map[string]string)
+	for _, pair := range strings.Split(c.Label(LABEL_SERVICES), ",") {
+		if i := strings.Index(pair, "="); i > 0 {
+			vars[pair[:i]] = pair[i+1:]
+		}
+	}
+	return vars
+}
+
+func servicesLabel(vars map[string]string) string {
+	pairs := make([]string, 0, len(vars))
+	for name, value := range vars {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
 }
 
 type Port struct {
@@ -29,28 +65,60 @@ type Port struct {
 	IP      string `json:"IP"`
 }
 
+// Labels set on the containers goobernet creates
+const (
+	LABEL_PROJECT     = "goobernet.project"
+	LABEL_PROJECT_ID  = "goobernet.project.id"
+	LABEL_ENVIRONMENT = "goobernet.environment"
+	LABEL_PORT        = "goobernet.port"
+	// which goobernet manages the container, when several share a docker host
+	LABEL_INSTANCE = "goobernet.instance"
+	// the service variables the container was started with, as
+	// comma separated name=value pairs
+	LABEL_SERVICES = "goobernet.services"
+)
+
 type Label struct {
 	Name  string `json:"name"`
 	Value string `json:"value"`
 }
 
-func init() {
-	var err error
-	client, err = docker.NewClient("unix:///var/run/docker.sock")
+// Wraps the docker API client, exposing only what goobernet needs
+type Client struct {
+	api      *docker.Client
+	instance string
+}
+
+// Connects to the docker daemon at endpoint, e.g.
+// unix:///var/run/docker.sock. Containers created through the client
+// are labelled as belonging to instance.
+func NewClient(endpoint, instance string) (*Client, error) {
+	api, err := docker.NewClient(endpoint)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error connecting to docker: %s\n", err.Error())
+		return nil, err
 	}
+	return &Client{api, instance}, nil
 }
 
-var client *docker.Client
+func (c *Client) Instance() string {
+	return c.instance
+}
 
-func GetContainers() ([]Container, error) {
+// Lists containers, limited to those with all of the given labels
+func (c *Client) GetContainers(labels map[string]string) ([]Container, error) {
 	listOpts := docker.ListContainersOptions{}
 	listOpts.All = true
 	listOpts.Limit = 1000
 	listOpts.Size = true
+	if len(labels) > 0 {
+		labelFilters := make([]string, 0, len(labels))
+		for k, v := range labels {
+			labelFilters = append(labelFilters, k+"="+v)
+		}
+		listOpts.Filters = map[string][]string{"label": labelFilters}
+	}
 
-	apiContainers, err := client.ListContainers(listOpts)
+	apiContainers, err := c.api.ListContainers(listOpts)
 
 	if err != nil {
 		return nil, err
@@ -84,6 +152,7 @@ func GetContainers() ([]Container, error) {
 			Labels:     labels,
 			RootFsSize: c.SizeRootFs,
 			RwSize:     c.SizeRw,
+			State:      c.State,
 			Status:     c.Status,
 		}
 
@@ -93,36 +162,12 @@ func GetContainers() ([]Container, error) {
 	return containers, nil
 }
 
-// remove me soon
-func exampleCreate() {
-	ports := make([]Port, 0, 1)
-	ports = append(ports, Port{Private: 8080, Public: 8080, Type: "tcp"})
-
-	vars := make(map[string]string)
-	vars["env-var"] = "env-val"
-
-	registry := data.GetConfig().Registry
-
-	containerName := "bpc-core-service"
-	img := registry + "/" + containerName
-	fmt.Printf("Creating from img: %s\n", img)
-	ctr, err := CreateContainer(containerName, img, "dev", ports, vars)
-
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating container: %s\n", err.Error())
-	}
-
-	err = StartContainer(ctr.ID)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error starting container: %s\n", err.Error())
-	}
-}
-
-func CreateContainer(containerName, image, domain string, portsToMap []Port, environmentVars map[string]string) (*docker.Container, error) {
+func (c *Client) CreateContainer(containerName, image, domain string, portsToMap []Port, environmentVars, labels map[string]string) (*docker.Container, error) {
 	cfg := &docker.Config{}
 	cfg.Image = image
 	cfg.Hostname = containerName
 	cfg.Domainname = domain
+	cfg.Labels = labels
 
 	var e struct{}
 	exposedPorts := make(map[docker.Port]struct{})
@@ -158,10 +203,11 @@ func CreateContainer(containerName, image, domain string, portsToMap []Port, env
 	opts.Name = containerName
 	opts.HostConfig = hostCfg
 
-	json, _ := data.PrettyPrint(opts)
-	fmt.Printf("create options: %s\n", string(json))
+	// Env carries config values, which can be secrets, so only the
+	// names are logged
+	fmt.Printf("Creating container %s from %s with environment %s\n", containerName, image, strings.Join(envNames(environmentVars), ", "))
 
-	container, err := client.CreateContainer(opts)
+	container, err := c.api.CreateContainer(opts)
 
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error creating container: %s\n", err.Error())
@@ -172,7 +218,129 @@ func CreateContainer(containerName, image, domain string, portsToMap []Port, env
 	return container, err
 }
 
-func StartContainer(id string) error {
-	err := client.StartContainer(id, nil)
+func envNames(environmentVars map[string]string) []string {
+	names := make([]string, 0, len(environmentVars))
+	for k := range environmentVars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Starting a container that's already running does nothing
+func (c *Client) StartContainer(id string) error {
+	err := c.api.StartContainer(id, nil)
+	if _, ok := err.(*docker.ContainerAlreadyRunning); ok {
+		return nil
+	}
 	return err
 }
+
+// Asks the container to stop, killing it after timeout seconds.
+// Stopping a container that isn't running does nothing.
+func (c *Client) StopContainer(id string, timeout uint) error {
+	err := c.api.StopContainer(id, timeout)
+	if _, ok := err.(*docker.ContainerNotRunning); ok {
+		return nil
+	}
+	return err
+}
+
+func (c *Client) RestartContainer(id string, timeout uint) error {
+	return c.api.RestartContainer(id, timeout)
+}
+
+// Looks up a container by id or name, returning nil if there's no such container
+func (c *Client) FindContainer(idOrName string) (*docker.Container, error) {
+	container, err := c.api.InspectContainer(idOrName)
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return nil, nil
+	}
+	return container, err
+}
+
+// Removes a stopped container, or with force a running one too
+func (c *Client) RemoveContainer(id string, force bool) error {
+	return c.api.RemoveContainer(docker.RemoveContainerOptions{ID: id, Force: force})
+}
+
+func (c *Client) RenameContainer(id, name string) error {
+	return c.api.RenameContainer(docker.RenameContainerOptions{ID: id, Name: name})
+}
+
+// Whether err came from acting on a container that doesn't exist
+func IsNoSuchContainer(err error) bool {
+	_, ok := err.(*docker.NoSuchContainer)
+	return ok
+}
+
+// Containers are named after the environment and project they run,
+// so there is only ever one per deployment
+func DeploymentContainerName(d data.Deployment) string {
+	return d.Environment.Name + "-" + d.Project.ShortName
+}
+
+// The environment variables a deployment's container is created with.
+// A non-nil values is used instead of the stored config values.
+func DeploymentEnv(store data.Store, d data.Deployment, values map[string]string) (map[string]string, error) {
+	if values == nil {
+		env, err := data.EnvironmentVars(store, d)
+		if err != nil {
+			return nil, err
+		}
+		env["PORT"] = strconv.FormatUint(uint64(d.Port), 10)
+		return env, nil
+	}
+
+	env, err := data.ServiceVars(store, d)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range values {
+		env[k] = v
+	}
+	env["PORT"] = strconv.FormatUint(uint64(d.Port), 10)
+	return env, nil
+}
+
+// The config values in a container's environment, leaving out PORT and
+// the service variables, which depend on where things are deployed now
+func ConfigValuesFromEnv(env map[string]string) map[string]string {
+	if env == nil {
+		return nil
+	}
+	values := make(map[string]string)
+	for k, v := range env {
+		if k != "PORT" && !data.IsServiceVar(k) {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+// Creates a container called name for a deployment. The service
+// listens on the deployment's port, which it is told about through
+// PORT. Service variables for the rest of the environment and the
+// config values (the stored ones unless values is given) are injected
+// as environment variables.
+func (c *Client) CreateDeploymentContainer(store data.Store, d data.Deployment, name, image string, values map[string]string) (*docker.Container, error) {
+	env, err := DeploymentEnv(store, d, values)
+	if err != nil {
+		return nil, err
+	}
+	services, err := data.ServiceVars(store, d)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := map[string]string{
+		LABEL_PROJECT:     d.Project.ShortName,
+		LABEL_PROJECT_ID:  strconv.FormatUint(uint64(d.Project.Id), 10),
+		LABEL_ENVIRONMENT: d.Environment.Name,
+		LABEL_PORT:        strconv.FormatUint(uint64(d.Port), 10),
+		LABEL_INSTANCE:    c.instance,
+		LABEL_SERVICES:    servicesLabel(services),
+	}
+	ports := []Port{{Private: uint64(d.Port), Public: uint64(d.Port), Type: "tcp"}}
+	return c.CreateContainer(name, image, d.Environment.Hostname, ports, env, labels)
+}
@@ -0,0 +1,67 @@
+package docker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/travissimon/goobernet/data"
+)
+
+func TestDeploymentEnv(t *testing.T) {
+	store := data.NewMemoryStore(data.DefaultConfig())
+	environment, err := store.AddEnvironment(data.Environment{Name: "dev", Hostname: "localhost", StartingPort: 8000, Registry: "registry:5000"})
+	if err != nil {
+		t.Fatalf("AddEnvironment: %s", err)
+	}
+	var deployment data.Deployment
+	for _, shortName := range []string{"billing", "ledger"} {
+		project, err := store.AddProject(data.Project{Name: shortName, ShortName: shortName})
+		if err != nil {
+			t.Fatalf("AddProject: %s", err)
+		}
+		if deployment, err = store.AddDeployment(environment.Id, project.Id); err != nil {
+			t.Fatalf("AddDeployment: %s", err)
+		}
+	}
+	stored := map[string]string{"DB_PASSWORD": "hunter2", "LOG_LEVEL": "debug"}
+	if err := store.SetConfigValues(environment.Id, deployment.Project.Id, stored); err != nil {
+		t.Fatalf("SetConfigValues: %s", err)
+	}
+
+	env, err := DeploymentEnv(store, deployment, nil)
+	if err != nil {
+		t.Fatalf("DeploymentEnv: %s", err)
+	}
+	want := map[string]string{
+		"BILLING_SERVICE_HOST": "localhost",
+		"BILLING_SERVICE_PORT": "8000",
+		"DB_PASSWORD":          "hunter2",
+		"LOG_LEVEL":            "debug",
+		"PORT":                 "8001",
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("DeploymentEnv = %v, want %v", env, want)
+	}
+	if values := ConfigValuesFromEnv(env); !reflect.DeepEqual(values, stored) {
+		t.Errorf("ConfigValuesFromEnv = %v, want %v", values, stored)
+	}
+
+	// given values replace the stored ones, but not the port or services
+	env, err = DeploymentEnv(store, deployment, map[string]string{"DB_PASSWORD": "old"})
+	if err != nil {
+		t.Fatalf("DeploymentEnv: %s", err)
+	}
+	want = map[string]string{
+		"BILLING_SERVICE_HOST": "localhost",
+		"BILLING_SERVICE_PORT": "8000",
+		"DB_PASSWORD":          "old",
+		"PORT":                 "8001",
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("DeploymentEnv with values = %v, want %v", env, want)
+	}
+
+	if values := ConfigValuesFromEnv(nil); values != nil {
+		t.Errorf("ConfigValuesFromEnv(nil) = %v, want nil for nothing recorded", values)
+	}
+}
@@ -0,0 +1,50 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// Runs cmd inside the container and waits for it to finish, returning
+// its exit code and whatever it wrote
+func (c *Client) Exec(ctx context.Context, id string, cmd []string) (int, string, error) {
+	exec, err := c.api.CreateExec(docker.CreateExecOptions{
+		Context:      ctx,
+		Container:    id,
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return 0, "", err
+	}
+
+	var output bytes.Buffer
+	err = c.api.StartExec(exec.ID, docker.StartExecOptions{
+		Context:      ctx,
+		OutputStream: &output,
+		ErrorStream:  &output,
+	})
+	if err != nil {
+		return 0, output.String(), err
+	}
+
+	// the output can end slightly before docker records the exit code
+	for {
+		inspect, err := c.api.InspectExec(exec.ID)
+		if err != nil {
+			return 0, output.String(), err
+		}
+		if !inspect.Running {
+			return inspect.ExitCode, output.String(), nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, output.String(), ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
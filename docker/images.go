@@ -0,0 +1,84 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/travissimon/goobernet/data"
+)
+
+const DEFAULT_TAG = "latest"
+
+var (
+	imageTag    = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	imageDigest = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// Tags may be a name such as latest, a Jenkins build number, or an
+// image digest (sha256:...)
+func ValidateTag(tag string) error {
+	if !imageTag.MatchString(tag) && !imageDigest.MatchString(tag) {
+		return fmt.Errorf("'%s' is not a valid image tag or digest", tag)
+	}
+	return nil
+}
+
+// The full reference to image at tag, e.g. registry/project:42 or
+// registry/project@sha256:...
+func ImageRef(image, tag string) string {
+	if tag == "" {
+		tag = DEFAULT_TAG
+	}
+	if imageDigest.MatchString(tag) {
+		return image + "@" + tag
+	}
+	return image + ":" + tag
+}
+
+// Pulls image at tag, writing docker's progress messages to out as
+// they arrive. auth may be nil for registries that don't need it.
+func (c *Client) PullImage(image, tag string, auth *data.RegistryAuth, out io.Writer) error {
+	if tag == "" {
+		tag = DEFAULT_TAG
+	}
+	if err := ValidateTag(tag); err != nil {
+		return err
+	}
+
+	opts := docker.PullImageOptions{
+		Repository:   image,
+		Tag:          tag,
+		OutputStream: out,
+	}
+	var authConfig docker.AuthConfiguration
+	if auth != nil {
+		authConfig = docker.AuthConfiguration{
+			Username:      auth.Username,
+			Password:      auth.Password.Reveal(),
+			ServerAddress: auth.Registry,
+		}
+	}
+
+	if err := c.api.PullImage(opts, authConfig); err != nil {
+		return fmt.Errorf("Error pulling %s: %s", ImageRef(image, tag), err.Error())
+	}
+	return nil
+}
+
+// The registry digest of a pulled image, or "" if it has none (for
+// instance if it was built locally)
+func (c *Client) ImageDigest(imageRef string) (string, error) {
+	image, err := c.api.InspectImage(imageRef)
+	if err != nil {
+		return "", err
+	}
+	for _, repoDigest := range image.RepoDigests {
+		if i := strings.LastIndex(repoDigest, "@"); i >= 0 {
+			return repoDigest[i+1:], nil
+		}
+	}
+	return "", nil
+}
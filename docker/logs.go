@@ -0,0 +1,46 @@
+package docker
+
+import (
+	"context"
+	"io"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+type LogOptions struct {
+	// number of lines from the end, or "all"
+	Tail       string
+	Since      time.Time
+	Timestamps bool
+	Stdout     bool
+	Stderr     bool
+	// keep streaming new output until ctx is done
+	Follow bool
+}
+
+// Copies the container's logs to stdout and stderr. Containers run with
+// a TTY have no separate stderr, so everything goes to stdout.
+func (c *Client) Logs(ctx context.Context, id string, opts LogOptions, stdout, stderr io.Writer) error {
+	container, err := c.api.InspectContainer(id)
+	if err != nil {
+		return err
+	}
+
+	logOpts := docker.LogsOptions{
+		Context:      ctx,
+		Container:    container.ID,
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+		Tail:         opts.Tail,
+		Follow:       opts.Follow,
+		Stdout:       opts.Stdout,
+		Stderr:       opts.Stderr,
+		Timestamps:   opts.Timestamps,
+		RawTerminal:  container.Config != nil && container.Config.Tty,
+	}
+	if !opts.Since.IsZero() {
+		logOpts.Since = opts.Since.Unix()
+	}
+	return c.api.Logs(logOpts)
+}
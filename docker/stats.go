@@ -0,0 +1,122 @@
+package docker
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// Resource usage of a container, or the total over several
+type Stats struct {
+	ContainerId   string    `json:"containerId,omitempty"`
+	Name          string    `json:"name,omitempty"`
+	Read          time.Time `json:"read"`
+	CpuPercent    float64   `json:"cpuPercent"`
+	MemoryUsage   uint64    `json:"memoryUsage"`
+	MemoryLimit   uint64    `json:"memoryLimit"`
+	MemoryPercent float64   `json:"memoryPercent"`
+	NetworkRx     uint64    `json:"networkRx"`
+	NetworkTx     uint64    `json:"networkTx"`
+	BlockRead     uint64    `json:"blockRead"`
+	BlockWrite    uint64    `json:"blockWrite"`
+}
+
+// Adds another container's usage to the total. Memory limits are
+// summed too, so the percentage is of what the containers may use.
+func (s *Stats) Add(other Stats) {
+	s.CpuPercent += other.CpuPercent
+	s.MemoryUsage += other.MemoryUsage
+	s.MemoryLimit += other.MemoryLimit
+	s.NetworkRx += other.NetworkRx
+	s.NetworkTx += other.NetworkTx
+	s.BlockRead += other.BlockRead
+	s.BlockWrite += other.BlockWrite
+	if other.Read.After(s.Read) {
+		s.Read = other.Read
+	}
+	if s.MemoryLimit > 0 {
+		s.MemoryPercent = float64(s.MemoryUsage) / float64(s.MemoryLimit) * 100
+	}
+}
+
+// Takes a single sample of the container's usage. Docker measures CPU
+// over the second before the sample, so this takes a second or two.
+func (c *Client) GetStats(idOrName string) (*Stats, error) {
+	container, err := c.api.InspectContainer(idOrName)
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make(chan *docker.Stats)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.api.Stats(docker.StatsOptions{
+			ID:      container.ID,
+			Stats:   samples,
+			Stream:  false,
+			Timeout: 10 * time.Second,
+		})
+	}()
+
+	sample, ok := <-samples
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	if !ok || sample == nil {
+		return nil, errors.New("Docker returned no stats for " + idOrName)
+	}
+
+	stats := newStats(sample)
+	stats.ContainerId = container.ID
+	stats.Name = strings.TrimPrefix(container.Name, "/")
+	return &stats, nil
+}
+
+// Same sums as `docker stats`
+func newStats(sample *docker.Stats) Stats {
+	s := Stats{Read: sample.Read}
+
+	cpuDelta := float64(sample.CPUStats.CPUUsage.TotalUsage) - float64(sample.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(sample.CPUStats.SystemCPUUsage) - float64(sample.PreCPUStats.SystemCPUUsage)
+	cpus := float64(sample.CPUStats.OnlineCPUs)
+	if cpus == 0 {
+		cpus = float64(len(sample.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta > 0 && systemDelta > 0 {
+		s.CpuPercent = cpuDelta / systemDelta * cpus * 100
+	}
+
+	// page cache can be reclaimed, so it doesn't count as used
+	mem := sample.MemoryStats
+	cache := mem.Stats.InactiveFile
+	if cache == 0 {
+		cache = mem.Stats.TotalInactiveFile
+	}
+	if cache == 0 {
+		cache = mem.Stats.Cache
+	}
+	s.MemoryUsage = mem.Usage
+	if cache < s.MemoryUsage {
+		s.MemoryUsage -= cache
+	}
+	s.MemoryLimit = mem.Limit
+	if s.MemoryLimit > 0 {
+		s.MemoryPercent = float64(s.MemoryUsage) / float64(s.MemoryLimit) * 100
+	}
+
+	for _, n := range sample.Networks {
+		s.NetworkRx += n.RxBytes
+		s.NetworkTx += n.TxBytes
+	}
+	for _, entry := range sample.BlkioStats.IOServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			s.BlockRead += entry.Value
+		case "write":
+			s.BlockWrite += entry.Value
+		}
+	}
+	return s
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/travissimon/goobernet/data"
+)
+
+const ENVIRONMENTS_PATH = "/v1/environments/"
+
+// handles requests for /v1/environments
+func environmentsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		getEnvironmentsHandler(w, r)
+	case "POST":
+		handlePostEnvironment(w, r)
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+// handles requests for /v1/environments/(id),
+// /v1/environments/(environment-name)/deploy/(project-short-name)
+// and /v1/environments/(environment-name)/(stats|drift)
+func environmentHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path[len(ENVIRONMENTS_PATH):]
+	parts := strings.Split(path, "/")
+	if len(parts) == 3 && parts[1] == DEPLOY_SEGMENT {
+		deployHandler(parts[0], parts[2], w, r)
+		return
+	}
+	if len(parts) == 2 && parts[1] == STATS_SEGMENT {
+		environmentStatsHandler(parts[0], w, r)
+		return
+	}
+	if len(parts) == 2 && parts[1] == DRIFT_SEGMENT {
+		driftHandler(parts[0], w, r)
+		return
+	}
+
+	id, err := parseId(path)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid environment id: %s\n", err.Error())
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		handleGetEnvironment(id, w)
+	case "PUT":
+		handlePutEnvironment(id, w, r)
+	case "PATCH":
+		handlePatchEnvironment(id, w, r)
+	case "DELETE":
+		handleDeleteEnvironment(id, w)
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+func getEnvironmentsHandler(w http.ResponseWriter, r *http.Request) {
+	environments, err := store.GetEnvironments()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%s\n", err.Error())
+		return
+	}
+	marshalAndWrite(environments, w)
+}
+
+func handleGetEnvironment(id uint, w http.ResponseWriter) {
+	environment, err := store.GetEnvironmentById(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+	marshalAndWrite(environment, w)
+}
+
+func handlePostEnvironment(w http.ResponseWriter, r *http.Request) {
+	var environment data.Environment
+	if err := json.NewDecoder(r.Body).Decode(&environment); err != nil {
+		writeError(w, http.StatusBadRequest, "Error decoding environment json: %s\n", err.Error())
+		return
+	}
+	if err := data.ValidateEnvironment(environment); err != nil {
+		writeError(w, http.StatusBadRequest, "%s\n", err.Error())
+		return
+	}
+	environment, err := store.AddEnvironment(environment)
+	if err != nil {
+		writeError(w, http.StatusConflict, "Error saving environment: %s\n", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	marshalAndWrite(environment, w)
+}
+
+// replaces the whole environment
+func handlePutEnvironment(id uint, w http.ResponseWriter, r *http.Request) {
+	if _, err := store.GetEnvironmentById(id); err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+
+	var environment data.Environment
+	if err := json.NewDecoder(r.Body).Decode(&environment); err != nil {
+		writeError(w, http.StatusBadRequest, "Error decoding environment json: %s\n", err.Error())
+		return
+	}
+	environment.Id = id
+	saveEnvironment(environment, w)
+}
+
+// only overwrites the fields present in the request body
+func handlePatchEnvironment(id uint, w http.ResponseWriter, r *http.Request) {
+	environment, err := store.GetEnvironmentById(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&environment); err != nil {
+		writeError(w, http.StatusBadRequest, "Error decoding environment json: %s\n", err.Error())
+		return
+	}
+	environment.Id = id
+	saveEnvironment(environment, w)
+}
+
+func saveEnvironment(environment data.Environment, w http.ResponseWriter) {
+	if err := data.ValidateEnvironment(environment); err != nil {
+		writeError(w, http.StatusBadRequest, "%s\n", err.Error())
+		return
+	}
+	if err := store.UpdateEnvironment(environment); err != nil {
+		writeError(w, http.StatusConflict, "Error saving environment: %s\n", err.Error())
+		return
+	}
+	marshalAndWrite(environment, w)
+}
+
+func handleDeleteEnvironment(id uint, w http.ResponseWriter) {
+	if _, err := store.GetEnvironmentById(id); err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+	if err := store.DeleteEnvironment(id); err != nil {
+		writeError(w, http.StatusConflict, "Error deleting environment: %s\n", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
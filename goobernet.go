@@ -6,10 +6,13 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/travissimon/goobernet/ci"
 	"github.com/travissimon/goobernet/data"
 	"github.com/travissimon/goobernet/docker"
+	"github.com/travissimon/goobernet/health"
 )
 
 const (
@@ -20,6 +23,16 @@ const (
 // For now we're assuming that all environments live on the same server
 // This can be extended when/if that no longer holds
 
+// Set up in main, shared by all handlers
+var (
+	config       data.GoobernetConfig
+	store        data.Store
+	buildServer  ci.BuildServerProxy
+	dockerClient *docker.Client
+	checker      *health.Checker
+	stopTimeout  uint
+)
+
 func swaggerIndexHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "swagger/goobernet.swagger.json")
 }
@@ -39,43 +52,92 @@ func marshalAndWrite(obj interface{}, w http.ResponseWriter) {
 	fmt.Fprintf(w, "%s", json)
 }
 
-func getProjectsHandler(w http.ResponseWriter, r *http.Request) {
-	marshalAndWrite(data.GetProjects(), w)
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusMethodNotAllowed, "Method %s not supported on %s\n", r.Method, r.URL.Path)
 }
 
-func getEnvironmentsHandler(w http.ResponseWriter, r *http.Request) {
-	marshalAndWrite(data.GetEnvironments(), w)
+// Sends each write to the client straight away
+type flushWriter struct {
+	w http.ResponseWriter
+	f http.Flusher
 }
 
-func getDeploymentsHandler(w http.ResponseWriter, r *http.Request) {
-	marshalAndWrite(data.GetDeployments(), w)
+func newFlushWriter(w http.ResponseWriter) *flushWriter {
+	f, _ := w.(http.Flusher)
+	return &flushWriter{w, f}
 }
 
-func getTemplatesHandler(w http.ResponseWriter, r *http.Request) {
-	marshalAndWrite(data.GetTemplates(), w)
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if fw.f != nil {
+		fw.f.Flush()
+	}
+	return n, err
 }
 
-func getContainersHandler(w http.ResponseWriter, r *http.Request) {
-	containers, err := docker.GetContainers()
+// parses the numeric id at the end of a resource path
+func parseId(idStr string) (uint, error) {
+	id, err := strconv.ParseUint(idStr, 10, 32)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "Error retrieving docker containers: %s\n", err)
-		return
+		return 0, fmt.Errorf("'%s' is not a valid id", idStr)
 	}
-	marshalAndWrite(containers, w)
+	return uint(id), nil
+}
+
+type discoveredService struct {
+	Url    string `json:"url"`
+	Health string `json:"health,omitempty"`
 }
 
+// Maps each project's short name to its url. Deployments failing their
+// health check are left out unless ?all=true. With ?health=true each
+// url comes with the deployment's health.
 func getDiscoveryHandler(w http.ResponseWriter, r *http.Request) {
-	environment := string(r.URL.Path[len(DISCOVERY_PATH):])
-	deployments, err := data.GetDeploymentsByEnvironmentName(environment)
+	environmentName := string(r.URL.Path[len(DISCOVERY_PATH):])
+	environment, err := store.GetEnvironmentByName(environmentName)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+	deployments, err := store.GetDeploymentsByEnvironmentId(environment.Id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error with discovery: %s\n", err.Error())
+		return
+	}
+
+	all, err := store.GetDeployments()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "Error with discovery: %s\n", err.Error())
 		return
 	}
+
+	query := r.URL.Query()
+	showAll := query.Get("all") == "true"
+	services := make(map[string]discoveredService, len(deployments))
+	for _, d := range all {
+		if d.Environment.Id != environment.Id {
+			continue
+		}
+		service := discoveredService{Url: d.Url()}
+		if status, ok := checker.Status(d.Environment.Id, d.Project.Id); ok {
+			if !status.Serving() && !showAll {
+				delete(deployments, d.Project.ShortName)
+				continue
+			}
+			service.Health = status.Status
+		}
+		services[d.Project.ShortName] = service
+	}
+
+	if query.Get("health") == "true" {
+		marshalAndWrite(services, w)
+		return
+	}
 	marshalAndWrite(deployments, w)
 }
 
 func getJobsHandler(w http.ResponseWriter, r *http.Request) {
-	jobs, err := ci.Proxy.GetTasks()
+	jobs, err := buildServer.GetTasks()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "Error querying ci server: %s\n", err.Error())
 		return
@@ -94,7 +156,7 @@ func getJobHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleGetJob(taskName string, w http.ResponseWriter) {
-	task, err := ci.Proxy.GetTaskDetails(taskName)
+	task, err := buildServer.GetTaskDetails(taskName)
 	if err != nil {
 		writeError(w, http.StatusNotFound, "Build task '%s' not found\n", taskName)
 		return
@@ -110,7 +172,11 @@ func handlePostJob(taskName string, w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "Error decoding project json: %s\n", err.Error())
 		return
 	}
-	err = ci.Proxy.CreateTask(project)
+	if _, err = ci.ResolveTemplate(store, project.BuildTemplate); err != nil {
+		writeError(w, http.StatusBadRequest, "Error finding build template: %s\n", err.Error())
+		return
+	}
+	err = buildServer.CreateTask(project)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "Error creating ci task: %s\n", err.Error())
 		return
@@ -122,15 +188,64 @@ func healthzHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(configCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		os.Exit(planCommand(os.Args[2:]))
+	}
+
 	var port = flag.String("port", "7777", "Define which TCP port to bind to")
+	var opts = addStoreFlags(flag.CommandLine)
+	var dockerOpts = addDockerFlags(flag.CommandLine)
+	var reconcileInterval = flag.Duration("reconcile-interval", time.Minute, "How often to bring containers in line with deployments, 0 to never")
+	flag.UintVar(&stopTimeout, "stop-timeout", 10, "Seconds to wait for a container to stop before killing it")
 	flag.Parse()
 
+	var err error
+	store, err = opts.open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config data: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	config, err = opts.loadConfig(store)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	buildServer, err = ci.NewJenkinsProxy(config, store)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not connect to Jenkins build server: %s\n", err.Error())
+		fmt.Fprintf(os.Stderr, "Please check your connection and configuration settings\n")
+	}
+
+	dockerClient, err = dockerOpts.connect()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to docker: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	checker = health.NewChecker(store, dockerClient)
+	checker.Start(time.Second)
+
+	if *reconcileInterval > 0 {
+		startReconciler(*reconcileInterval)
+	}
+
 	http.Handle("/swagger/", http.StripPrefix("/swagger/", http.FileServer(http.Dir("swagger"))))
-	http.HandleFunc("/v1/projects", getProjectsHandler)
-	http.HandleFunc("/v1/environments", getEnvironmentsHandler)
-	http.HandleFunc("/v1/deployments", getDeploymentsHandler)
+	http.HandleFunc("/v1/projects", projectsHandler)
+	http.HandleFunc(PROJECTS_PATH, projectHandler)
+	http.HandleFunc("/v1/environments", environmentsHandler)
+	http.HandleFunc(ENVIRONMENTS_PATH, environmentHandler)
+	http.HandleFunc("/v1/deployments", deploymentsHandler)
+	http.HandleFunc(DEPLOYMENTS_PATH, deploymentHandler)
 	http.HandleFunc("/v1/containers", getContainersHandler)
-	http.HandleFunc("/v1/templates", getTemplatesHandler)
+	http.HandleFunc(CONTAINERS_PATH, containerHandler)
+	http.HandleFunc(CONFIG_PATH, configValuesHandler)
+	http.HandleFunc("/v1/templates", templatesHandler)
+	http.HandleFunc(TEMPLATES_PATH, templateHandler)
 	http.HandleFunc(JOB_PATH, getJobHandler)
 	http.HandleFunc("/v1/jobs", getJobsHandler)
 	http.HandleFunc(DISCOVERY_PATH, getDiscoveryHandler)
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/travissimon/goobernet/data"
+	"github.com/travissimon/goobernet/health"
+)
+
+func TestDiscovery(t *testing.T) {
+	memory := data.NewMemoryStore(data.DefaultConfig())
+	environment, err := memory.AddEnvironment(data.Environment{Name: "dev", Hostname: "localhost", StartingPort: 8000, Registry: "registry:5000"})
+	if err != nil {
+		t.Fatalf("AddEnvironment: %s", err)
+	}
+	project, err := memory.AddProject(data.Project{Name: "Billing", ShortName: "billing"})
+	if err != nil {
+		t.Fatalf("AddProject: %s", err)
+	}
+	if _, err := memory.AddDeployment(environment.Id, project.Id); err != nil {
+		t.Fatalf("AddDeployment: %s", err)
+	}
+
+	oldStore, oldChecker := store, checker
+	store, checker = memory, health.NewChecker(memory, nil)
+	defer func() { store, checker = oldStore, oldChecker }()
+
+	tests := []struct {
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{DISCOVERY_PATH + "dev", http.StatusOK, `"billing":"localhost:8000"`},
+		{DISCOVERY_PATH + "staging", http.StatusNotFound, "staging"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		getDiscoveryHandler(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.wantCode || !strings.Contains(w.Body.String(), test.wantBody) {
+			t.Errorf("GET %s = %d %s, want %d containing %s", test.path, w.Code, w.Body.String(), test.wantCode, test.wantBody)
+		}
+	}
+}
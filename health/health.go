@@ -0,0 +1,209 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/travissimon/goobernet/data"
+	"github.com/travissimon/goobernet/docker"
+)
+
+// Health of a deployment, as last decided by the checker
+const (
+	// no check has changed the status yet
+	STATUS_UNKNOWN   = "unknown"
+	STATUS_HEALTHY   = "healthy"
+	STATUS_UNHEALTHY = "unhealthy"
+)
+
+type Status struct {
+	Status    string    `json:"status"`
+	LastCheck time.Time `json:"lastCheck,omitempty"`
+	// why the last probe failed
+	LastError string `json:"lastError,omitempty"`
+	// consecutive probes that agreed with the last one
+	Streak uint `json:"streak"`
+
+	lastPassed bool
+	due        time.Time
+	checking   bool
+}
+
+// Whether discovery should hand out the deployment. Deployments are
+// assumed healthy until their check says otherwise.
+func (s Status) Serving() bool {
+	return s.Status != STATUS_UNHEALTHY
+}
+
+type key struct {
+	environmentId uint
+	projectId     uint
+}
+
+// Probes every deployment whose project has a health check, keeping
+// the results in memory
+type Checker struct {
+	mu       sync.RWMutex
+	store    data.Store
+	docker   *docker.Client
+	statuses map[key]*Status
+}
+
+func NewChecker(store data.Store, dc *docker.Client) *Checker {
+	return &Checker{
+		store:    store,
+		docker:   dc,
+		statuses: make(map[key]*Status),
+	}
+}
+
+// Looks at deployments every tick, probing those that are due
+func (c *Checker) Start(tick time.Duration) {
+	go func() {
+		for {
+			c.checkDue(time.Now())
+			time.Sleep(tick)
+		}
+	}()
+}
+
+// The deployment's health, and false if its project isn't checked
+func (c *Checker) Status(environmentId, projectId uint) (Status, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	status, ok := c.statuses[key{environmentId, projectId}]
+	if !ok {
+		return Status{}, false
+	}
+	return *status, true
+}
+
+func (c *Checker) checkDue(now time.Time) {
+	deployments, err := c.store.GetDeployments()
+	if err != nil {
+		// keep what's known rather than forgetting every status
+		fmt.Fprintf(os.Stderr, "Error reading deployments to health check: %s\n", err.Error())
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current := make(map[key]bool, len(deployments))
+	for _, d := range deployments {
+		check := d.Project.HealthCheck
+		if !check.Enabled() {
+			continue
+		}
+		k := key{d.Environment.Id, d.Project.Id}
+		current[k] = true
+
+		status, ok := c.statuses[k]
+		if !ok {
+			status = &Status{Status: STATUS_UNKNOWN}
+			c.statuses[k] = status
+		}
+		if status.checking || now.Before(status.due) {
+			continue
+		}
+		status.checking = true
+		status.due = now.Add(check.IntervalDuration())
+		go c.check(k, d)
+	}
+
+	// undeployed, or the project's check was removed
+	for k := range c.statuses {
+		if !current[k] {
+			delete(c.statuses, k)
+		}
+	}
+}
+
+func (c *Checker) check(k key, d data.Deployment) {
+	check := d.Project.HealthCheck
+	ctx, cancel := context.WithTimeout(context.Background(), check.TimeoutDuration())
+	err := Probe(ctx, c.docker, check, d.Environment.Hostname, d.Port, docker.DeploymentContainerName(d))
+	cancel()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status, ok := c.statuses[k]
+	if !ok {
+		return
+	}
+	status.checking = false
+	status.record(check, err == nil, err, time.Now())
+}
+
+// Moves to healthy or unhealthy once enough probes in a row agree
+func (s *Status) record(check data.HealthCheck, passed bool, err error, at time.Time) {
+	if passed == s.lastPassed && s.Streak > 0 {
+		s.Streak++
+	} else {
+		s.Streak = 1
+	}
+	s.lastPassed = passed
+	s.LastCheck = at
+	s.LastError = ""
+	if err != nil {
+		s.LastError = err.Error()
+	}
+
+	if passed && s.Streak >= check.Healthy() {
+		s.Status = STATUS_HEALTHY
+	} else if !passed && s.Streak >= check.Unhealthy() {
+		s.Status = STATUS_UNHEALTHY
+	}
+}
+
+// Runs check once against the service on host:port, or for command
+// checks inside the named container. It gives up when ctx is done.
+func Probe(ctx context.Context, dc *docker.Client, check data.HealthCheck, host string, port uint, container string) error {
+	address := net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+	switch check.Type {
+	case data.HEALTH_TCP:
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case data.HEALTH_HTTP:
+		req, err := http.NewRequest("GET", "http://"+address+check.Path, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("%s answered %s", check.Path, resp.Status)
+		}
+		return nil
+
+	case data.HEALTH_COMMAND:
+		if dc == nil {
+			return errors.New("No docker connection to run the command with")
+		}
+		code, output, err := dc.Exec(ctx, container, check.Command)
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return fmt.Errorf("'%s' exited %d: %s", strings.Join(check.Command, " "), code, strings.TrimSpace(output))
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown health check type '%s'", check.Type)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/travissimon/goobernet/data"
+	"github.com/travissimon/goobernet/docker"
+)
+
+// Records a successful deploy as the deployment's next revision.
+// Failing to record it doesn't undo the deploy, so anything that goes
+// wrong is added to the response's warnings.
+func recordRevision(resp *deployResponse, tag, triggeredBy string, rollbackOf uint) {
+	d := resp.Deployment
+	rev := data.Revision{
+		EnvironmentId: d.Environment.Id,
+		ProjectId:     d.Project.Id,
+		Image:         resp.Image,
+		Tag:           tag,
+		Port:          d.Port,
+		TriggeredBy:   triggeredBy,
+		Timestamp:     time.Now().UTC(),
+		RollbackOf:    rollbackOf,
+	}
+	if build, err := strconv.ParseUint(tag, 10, 64); err == nil {
+		rev.BuildNumber = build
+	}
+
+	digest, err := dockerClient.ImageDigest(resp.Image)
+	if err != nil {
+		resp.Warnings = append(resp.Warnings, fmt.Sprintf("Couldn't find the digest of %s, so rolling back to this revision uses its tag: %s", resp.Image, err.Error()))
+	}
+	rev.Digest = digest
+
+	if rev.EnvironmentVars, err = docker.DeploymentEnv(store, d, resp.values); err != nil {
+		resp.Warnings = append(resp.Warnings, fmt.Sprintf("Couldn't record the environment of %s: %s", resp.Image, err.Error()))
+	}
+
+	rev, err = store.AddRevision(rev)
+	if err != nil {
+		resp.Warnings = append(resp.Warnings, fmt.Sprintf("Couldn't record the deploy in the history: %s", err.Error()))
+		return
+	}
+	resp.Revision = rev.Revision
+}
+
+// There's no authentication, so this is whoever a proxy in front of
+// goobernet says it is, or else where the request came from
+func triggeredBy(r *http.Request) string {
+	if user := r.Header.Get("X-Forwarded-User"); user != "" {
+		return user
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		return user
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// The tag to deploy a revision's image again with. The tag may since
+// have been pushed again, the digest can't have been.
+func revisionTag(revision data.Revision) string {
+	if revision.Digest != "" {
+		return revision.Digest
+	}
+	if revision.Tag != "" {
+		return revision.Tag
+	}
+	return docker.DEFAULT_TAG
+}
+
+// The deployment's most recent revision, or nil if it has no history
+func lastRevision(d data.Deployment) (*data.Revision, error) {
+	revisions, err := store.GetRevisions(d.Environment.Id, d.Project.Id)
+	if err != nil || len(revisions) == 0 {
+		return nil, err
+	}
+	return &revisions[len(revisions)-1], nil
+}
+
+// handles GET /v1/deployments/(environment-name)/(project-short-name)/history
+func handleGetHistory(environment data.Environment, project data.Project, w http.ResponseWriter) {
+	revisions, err := store.GetRevisions(environment.Id, project.Id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%s\n", err.Error())
+		return
+	}
+	redacted := make([]data.Revision, len(revisions))
+	for i, revision := range revisions {
+		redacted[i] = revision.Redacted()
+	}
+	marshalAndWrite(redacted, w)
+}
+
+// handles POST /v1/deployments/(environment-name)/(project-short-name)/rollback?revision=n
+//
+// Redeploys the image the revision ran, by digest where there is one,
+// with the config values it ran with. The port and service variables
+// are the current ones, as the rest of the environment has moved on.
+func handleRollback(environment data.Environment, project data.Project, w http.ResponseWriter, r *http.Request) {
+	revisionStr := r.URL.Query().Get("revision")
+	revisionNumber, err := parseId(revisionStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid revision: %s\n", err.Error())
+		return
+	}
+	ro, err := parseRollout(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%s\n", err.Error())
+		return
+	}
+
+	deployLock.Lock()
+	defer deployLock.Unlock()
+
+	deployment, err := store.GetDeployment(environment.Id, project.Id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+	revision, err := store.GetRevision(environment.Id, project.Id, revisionNumber)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+
+	values := docker.ConfigValuesFromEnv(revision.EnvironmentVars)
+	resp, err := runDeployment(deployment, revisionTag(revision), values, ro, ioutil.Discard)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error rolling '%s' in '%s' back to revision %d: %s\n",
+			project.ShortName, environment.Name, revision.Revision, err.Error())
+		return
+	}
+	if values == nil {
+		resp.Warnings = append(resp.Warnings, fmt.Sprintf("Revision %d has no recorded environment, so the current config values were used", revision.Revision))
+	}
+	recordRevision(resp, revision.Tag, triggeredBy(r), revision.Revision)
+	marshalAndWrite(resp, w)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/travissimon/goobernet/data"
+)
+
+func TestHistoryRedactsEnvironment(t *testing.T) {
+	memory := data.NewMemoryStore(data.DefaultConfig())
+	environment, err := memory.AddEnvironment(data.Environment{Name: "dev", Hostname: "localhost", StartingPort: 8000, Registry: "registry:5000"})
+	if err != nil {
+		t.Fatalf("AddEnvironment: %s", err)
+	}
+	project, err := memory.AddProject(data.Project{Name: "Billing", ShortName: "billing"})
+	if err != nil {
+		t.Fatalf("AddProject: %s", err)
+	}
+	if _, err := memory.AddDeployment(environment.Id, project.Id); err != nil {
+		t.Fatalf("AddDeployment: %s", err)
+	}
+	if _, err := memory.AddRevision(data.Revision{
+		EnvironmentId:   environment.Id,
+		ProjectId:       project.Id,
+		Image:           "registry:5000/billing",
+		Tag:             "42",
+		EnvironmentVars: map[string]string{"DB_PASSWORD": "hunter2"},
+	}); err != nil {
+		t.Fatalf("AddRevision: %s", err)
+	}
+
+	oldStore := store
+	store = memory
+	defer func() { store = oldStore }()
+
+	w := httptest.NewRecorder()
+	handleGetHistory(environment, project, w)
+	body := w.Body.String()
+	if strings.Contains(body, "hunter2") || !strings.Contains(body, "DB_PASSWORD") {
+		t.Errorf("history shows %s, want the variable's name but not its value", body)
+	}
+
+	// the recorded value is kept for rolling back to
+	revisions, _ := memory.GetRevisions(environment.Id, project.Id)
+	if revisions[0].EnvironmentVars["DB_PASSWORD"] != "hunter2" {
+		t.Errorf("redacting changed the recorded revision: %v", revisions[0].EnvironmentVars)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/travissimon/goobernet/docker"
+)
+
+// handles GET /v1/containers/(id or name)/logs
+//
+// ?tail=n (default all), ?since= (unix seconds, RFC 3339 or a duration
+// such as 10m), ?timestamps=true, ?stdout=false / ?stderr=false and
+// ?follow=true. Logs are plain text, or server-sent events with a
+// stdout or stderr event per line when the client accepts text/event-stream.
+func handleContainerLogs(id string, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts := docker.LogOptions{
+		Tail:       "all",
+		Timestamps: query.Get("timestamps") == "true",
+		Stdout:     query.Get("stdout") != "false",
+		Stderr:     query.Get("stderr") != "false",
+		Follow:     query.Get("follow") == "true",
+	}
+	if tail := query.Get("tail"); tail != "" && tail != "all" {
+		if _, err := strconv.ParseUint(tail, 10, 32); err != nil {
+			writeError(w, http.StatusBadRequest, "'%s' is not a valid number of lines\n", tail)
+			return
+		}
+		opts.Tail = tail
+	}
+	if since := query.Get("since"); since != "" {
+		var err error
+		if opts.Since, err = parseSince(since); err != nil {
+			writeError(w, http.StatusBadRequest, "%s\n", err.Error())
+			return
+		}
+	}
+	if !opts.Stdout && !opts.Stderr {
+		writeError(w, http.StatusBadRequest, "At least one of stdout and stderr is needed\n")
+		return
+	}
+
+	container, err := dockerClient.FindContainer(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error inspecting container: %s\n", err.Error())
+		return
+	}
+	if container == nil {
+		writeError(w, http.StatusNotFound, "Unable to find container: %s\n", id)
+		return
+	}
+
+	var stdout, stderr io.Writer
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		events := &eventWriter{out: newFlushWriter(w)}
+		stdout, stderr = events.stream("stdout"), events.stream("stderr")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		var out io.Writer = w
+		if opts.Follow {
+			out = newFlushWriter(w)
+		}
+		stdout, stderr = out, out
+	}
+
+	// headers have gone by the time anything fails, so all we can do is log it
+	if err := dockerClient.Logs(r.Context(), container.ID, opts, stdout, stderr); err != nil && r.Context().Err() == nil {
+		fmt.Fprintf(os.Stderr, "Error reading logs for %s: %s\n", id, err.Error())
+	}
+}
+
+func parseSince(since string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(since, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("'%s' is not a unix time, RFC 3339 time or duration", since)
+}
+
+// Writes each line as a server-sent event named after the stream it
+// came from. Partial lines are held until they're finished.
+type eventWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+type eventStream struct {
+	events  *eventWriter
+	name    string
+	partial []byte
+}
+
+func (ew *eventWriter) stream(name string) io.Writer {
+	return &eventStream{events: ew, name: name}
+}
+
+func (es *eventStream) Write(p []byte) (int, error) {
+	es.partial = append(es.partial, p...)
+	for {
+		i := bytes.IndexByte(es.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSuffix(string(es.partial[:i]), "\r")
+		es.partial = es.partial[i+1:]
+
+		es.events.mu.Lock()
+		_, err := fmt.Fprintf(es.events.out, "event: %s\ndata: %s\n\n", es.name, line)
+		es.events.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/travissimon/goobernet/data"
+	"github.com/travissimon/goobernet/docker"
+)
+
+// What goobernet would do to a container
+const (
+	PLAN_CREATE   = "create"
+	PLAN_RECREATE = "recreate"
+	PLAN_STOP     = "stop"
+	PLAN_REMOVE   = "remove"
+)
+
+type planStep struct {
+	Action      string `json:"action"`
+	Environment string `json:"environment"`
+	Project     string `json:"project"`
+	Container   string `json:"container"`
+	ContainerId string `json:"containerId,omitempty"`
+	Image       string `json:"image,omitempty"`
+	Port        uint   `json:"port,omitempty"`
+	// the port would be allocated by this change, rather than already held
+	NewPort bool `json:"newPort,omitempty"`
+}
+
+func (s planStep) String() string {
+	str := fmt.Sprintf("%s: %s %s", s.Environment, s.Action, s.Container)
+	if s.Image != "" && (s.Action == PLAN_CREATE || s.Action == PLAN_RECREATE) {
+		str += " from " + s.Image
+	}
+	if s.Port != 0 {
+		str += fmt.Sprintf(" on port %d", s.Port)
+		if s.NewPort {
+			str += " (new)"
+		}
+	}
+	return str
+}
+
+type plan struct {
+	DryRun bool       `json:"dryRun"`
+	Steps  []planStep `json:"steps"`
+}
+
+// The steps a deploy would take. Only reads from docker.
+func planDeploy(environment data.Environment, project data.Project, tag string, ro rollout) (*plan, error) {
+	deployments, err := store.GetDeployments()
+	if err != nil {
+		return nil, err
+	}
+	deployment, err := store.GetDeployment(environment.Id, project.Id)
+	newPort := err != nil
+	if newPort {
+		port, err := data.NextFreePort(environment, deployments)
+		if err != nil {
+			return nil, err
+		}
+		deployment = data.Deployment{Project: project, Environment: environment, Port: port}
+	}
+
+	name := docker.DeploymentContainerName(deployment)
+	existing, err := dockerClient.FindContainer(name)
+	if err != nil {
+		return nil, err
+	}
+
+	step := planStep{
+		Action:      PLAN_CREATE,
+		Environment: environment.Name,
+		Project:     project.ShortName,
+		Container:   name,
+		Image:       docker.ImageRef(deployment.Image(), tag),
+		Port:        deployment.Port,
+		NewPort:     newPort,
+	}
+	if existing == nil {
+		return &plan{true, []planStep{step}}, nil
+	}
+	if ro.Strategy != STRATEGY_BLUE_GREEN || !existing.State.Running {
+		step.Action, step.ContainerId = PLAN_RECREATE, existing.ID
+		return &plan{true, []planStep{step}}, nil
+	}
+
+	// the new container comes up beside the old one, and the
+	// deployment moves to its port
+	port, err := data.NextFreePort(environment, deployments)
+	if err != nil {
+		return nil, err
+	}
+	step.Container, step.Port, step.NewPort = nextContainerName(deployment), port, true
+	old := planStep{
+		Environment: environment.Name,
+		Project:     project.ShortName,
+		Container:   name,
+		ContainerId: existing.ID,
+		Port:        deployment.Port,
+	}
+	stop, remove := old, old
+	stop.Action, remove.Action = PLAN_STOP, PLAN_REMOVE
+	return &plan{true, []planStep{step, stop, remove}}, nil
+}
+
+// The steps an undeploy would take. Only reads from docker.
+func planUndeploy(deployment data.Deployment) (*plan, error) {
+	name := docker.DeploymentContainerName(deployment)
+	existing, err := dockerClient.FindContainer(name)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &plan{DryRun: true, Steps: make([]planStep, 0, 2)}
+	if existing == nil {
+		return p, nil
+	}
+	step := planStep{
+		Environment: deployment.Environment.Name,
+		Project:     deployment.Project.ShortName,
+		Container:   name,
+		ContainerId: existing.ID,
+		Port:        deployment.Port,
+	}
+	if existing.State.Running {
+		step.Action = PLAN_STOP
+		p.Steps = append(p.Steps, step)
+	}
+	step.Action = PLAN_REMOVE
+	p.Steps = append(p.Steps, step)
+	return p, nil
+}
+
+// The steps reconciling the environment would take
+func planReconcile(environment data.Environment) ([]planStep, error) {
+	drift, err := findDrift(environment)
+	if err != nil {
+		return nil, err
+	}
+	return driftSteps(drift), nil
+}
+
+// The steps fixing drift would take
+func driftSteps(drift *environmentDrift) []planStep {
+	steps := make([]planStep, 0, len(drift.Drift))
+	for _, item := range drift.Drift {
+		step := planStep{
+			Environment: drift.Environment,
+			Project:     item.Project,
+			Container:   item.Container,
+			ContainerId: item.ContainerId,
+			Image:       item.Image,
+			Port:        item.Port,
+		}
+
+		switch item.Action {
+		case ACTION_CREATE:
+			step.Action = PLAN_CREATE
+		case ACTION_RECREATE:
+			step.Action = PLAN_RECREATE
+		case ACTION_REMOVE:
+			if item.State == "running" {
+				step.Action = PLAN_STOP
+				steps = append(steps, step)
+			}
+			step.Action = PLAN_REMOVE
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// handles ?dryRun=true on /v1/environments/(environment-name)/deploy/(project-short-name)
+func handlePlanDeploy(environment data.Environment, project data.Project, w http.ResponseWriter, r *http.Request) {
+	tag, err := parseTag(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%s\n", err.Error())
+		return
+	}
+	ro, err := parseRollout(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%s\n", err.Error())
+		return
+	}
+	p, err := planDeploy(environment, project, tag, ro)
+	if err != nil {
+		writeError(w, http.StatusConflict, "Error planning deployment: %s\n", err.Error())
+		return
+	}
+	marshalAndWrite(p, w)
+}
+
+func handlePlanUndeploy(environment data.Environment, project data.Project, w http.ResponseWriter) {
+	deployment, err := store.GetDeployment(environment.Id, project.Id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+	p, err := planUndeploy(deployment)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error planning undeploy: %s\n", err.Error())
+		return
+	}
+	marshalAndWrite(p, w)
+}
+
+const planUsage = `Usage:
+  goobernet plan [flags] [environment]
+      Lists what reconciling would change in the environment, or in
+      every environment (including removing the containers of deleted
+      ones), without changing anything. The store is opened read only,
+      so it must already exist and be migrated; plan won't create,
+      migrate or import one.
+`
+
+// handles `goobernet plan ...`, returning the exit code
+func planCommand(args []string) int {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, planUsage)
+		fs.PrintDefaults()
+	}
+	opts := addStoreFlags(fs)
+	dockerOpts := addDockerFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+
+	var err error
+	if store, err = opts.openReadOnly(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config data: %s\n", err.Error())
+		return 1
+	}
+	if dockerClient, err = dockerOpts.connect(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to docker: %s\n", err.Error())
+		return 1
+	}
+
+	environments, err := store.GetEnvironments()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	if fs.NArg() == 1 {
+		environment, err := store.GetEnvironmentByName(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 1
+		}
+		environments = []data.Environment{environment}
+	}
+
+	changes := 0
+	for _, environment := range environments {
+		steps, err := planReconcile(environment)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error planning %s: %s\n", environment.Name, err.Error())
+			return 1
+		}
+		for _, step := range steps {
+			fmt.Println(step)
+		}
+		changes += len(steps)
+	}
+
+	if fs.NArg() == 0 {
+		orphaned, err := findOrphanedEnvironments(environments)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error planning deleted environments: %s\n", err.Error())
+			return 1
+		}
+		for _, drift := range orphaned {
+			for _, step := range driftSteps(drift) {
+				fmt.Println(step)
+				changes++
+			}
+		}
+	}
+
+	if changes == 0 {
+		fmt.Println("No changes. Containers match deployments.")
+	}
+	return 0
+}
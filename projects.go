@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/travissimon/goobernet/data"
+)
+
+const PROJECTS_PATH = "/v1/projects/"
+
+// handles requests for /v1/projects
+func projectsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		getProjectsHandler(w, r)
+	case "POST":
+		handlePostProject(w, r)
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+// handles requests for /v1/projects/(id)
+func projectHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseId(r.URL.Path[len(PROJECTS_PATH):])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid project id: %s\n", err.Error())
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		handleGetProject(id, w)
+	case "PUT":
+		handlePutProject(id, w, r)
+	case "PATCH":
+		handlePatchProject(id, w, r)
+	case "DELETE":
+		handleDeleteProject(id, w)
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+func getProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	projects, err := store.GetProjects()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%s\n", err.Error())
+		return
+	}
+	marshalAndWrite(projects, w)
+}
+
+func handleGetProject(id uint, w http.ResponseWriter) {
+	project, err := store.GetProjectById(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+	marshalAndWrite(project, w)
+}
+
+func handlePostProject(w http.ResponseWriter, r *http.Request) {
+	var project data.Project
+	if err := json.NewDecoder(r.Body).Decode(&project); err != nil {
+		writeError(w, http.StatusBadRequest, "Error decoding project json: %s\n", err.Error())
+		return
+	}
+	if err := data.ValidateProject(project); err != nil {
+		writeError(w, http.StatusBadRequest, "%s\n", err.Error())
+		return
+	}
+	project, err := store.AddProject(project)
+	if err != nil {
+		writeError(w, http.StatusConflict, "Error saving project: %s\n", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	marshalAndWrite(project, w)
+}
+
+// replaces the whole project
+func handlePutProject(id uint, w http.ResponseWriter, r *http.Request) {
+	if _, err := store.GetProjectById(id); err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+
+	var project data.Project
+	if err := json.NewDecoder(r.Body).Decode(&project); err != nil {
+		writeError(w, http.StatusBadRequest, "Error decoding project json: %s\n", err.Error())
+		return
+	}
+	project.Id = id
+	saveProject(project, w)
+}
+
+// only overwrites the fields present in the request body
+func handlePatchProject(id uint, w http.ResponseWriter, r *http.Request) {
+	project, err := store.GetProjectById(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&project); err != nil {
+		writeError(w, http.StatusBadRequest, "Error decoding project json: %s\n", err.Error())
+		return
+	}
+	project.Id = id
+	saveProject(project, w)
+}
+
+func saveProject(project data.Project, w http.ResponseWriter) {
+	if err := data.ValidateProject(project); err != nil {
+		writeError(w, http.StatusBadRequest, "%s\n", err.Error())
+		return
+	}
+	if err := store.UpdateProject(project); err != nil {
+		writeError(w, http.StatusConflict, "Error saving project: %s\n", err.Error())
+		return
+	}
+	marshalAndWrite(project, w)
+}
+
+func handleDeleteProject(id uint, w http.ResponseWriter) {
+	if _, err := store.GetProjectById(id); err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+	if err := store.DeleteProject(id); err != nil {
+		writeError(w, http.StatusConflict, "Error deleting project: %s\n", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/travissimon/goobernet/data"
+	"github.com/travissimon/goobernet/docker"
+)
+
+const DRIFT_SEGMENT = "drift"
+
+// What's wrong with a container, and what reconciling will do about it
+const (
+	DRIFT_MISSING    = "missing"
+	DRIFT_EXITED     = "exited"
+	DRIFT_WRONG_PORT = "wrongPort"
+	DRIFT_ORPHANED   = "orphaned"
+	// a service the container was told about has since moved, as
+	// happens to the rest of the environment after a blue/green deploy
+	DRIFT_STALE_SERVICES = "staleServices"
+
+	ACTION_CREATE   = "create"
+	ACTION_RECREATE = "recreate"
+	ACTION_REMOVE   = "remove"
+)
+
+type driftItem struct {
+	Project     string `json:"project"`
+	Container   string `json:"container"`
+	Problem     string `json:"problem"`
+	Action      string `json:"action"`
+	ContainerId string `json:"containerId,omitempty"`
+	Image       string `json:"image,omitempty"`
+	State       string `json:"state,omitempty"`
+	Port        uint   `json:"port,omitempty"`
+
+	deployment *data.Deployment
+	// what a missing container was last deployed from
+	revision *data.Revision
+}
+
+type environmentDrift struct {
+	Environment string      `json:"environment"`
+	InSync      bool        `json:"inSync"`
+	Drift       []driftItem `json:"drift"`
+}
+
+// Compares the environment's deployments with the containers this
+// goobernet manages in it
+func findDrift(environment data.Environment) (*environmentDrift, error) {
+	// read first, so a failed read can't make every container look orphaned
+	deployments, err := store.GetDeployments()
+	if err != nil {
+		return nil, err
+	}
+	containers, err := dockerClient.GetContainers(map[string]string{
+		docker.LABEL_INSTANCE:    dockerClient.Instance(),
+		docker.LABEL_ENVIRONMENT: environment.Name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]docker.Container)
+	for _, c := range containers {
+		byName[c.Name] = c
+	}
+
+	urls := make(map[string]string)
+	for _, d := range deployments {
+		if d.Environment.Id == environment.Id {
+			urls[d.Project.ShortName] = d.Url()
+		}
+	}
+
+	drift := &environmentDrift{Environment: environment.Name, Drift: make([]driftItem, 0, 5)}
+	deployed := make(map[string]bool)
+	for _, d := range deployments {
+		if d.Environment.Id != environment.Id {
+			continue
+		}
+		d := d
+		name := docker.DeploymentContainerName(d)
+		deployed[name] = true
+		if d.Stopped {
+			continue
+		}
+
+		c, ok := byName[name]
+		item := driftItem{Project: d.Project.ShortName, Container: name, Port: d.Port, deployment: &d}
+		switch {
+		case !ok:
+			item.Problem, item.Action = DRIFT_MISSING, ACTION_CREATE
+			if item.revision, err = lastRevision(d); err != nil {
+				return nil, err
+			}
+			tag := docker.DEFAULT_TAG
+			if item.revision != nil {
+				tag = revisionTag(*item.revision)
+			}
+			item.Image = docker.ImageRef(d.Image(), tag)
+		case c.State != "running":
+			item.Problem, item.Action = DRIFT_EXITED, ACTION_RECREATE
+		case c.Label(docker.LABEL_PORT) != strconv.FormatUint(uint64(d.Port), 10):
+			item.Problem, item.Action = DRIFT_WRONG_PORT, ACTION_RECREATE
+		default:
+			stale, err := staleServices(c, urls, d.Project.ShortName)
+			if err != nil {
+				return nil, err
+			}
+			if !stale {
+				continue
+			}
+			item.Problem, item.Action = DRIFT_STALE_SERVICES, ACTION_RECREATE
+		}
+		if ok {
+			item.ContainerId, item.Image, item.State = c.Id, c.Image, c.State
+		}
+		drift.Drift = append(drift.Drift, item)
+	}
+
+	// includes the new container from a blue/green deploy that died part way
+	for name, c := range byName {
+		if !deployed[name] {
+			drift.Drift = append(drift.Drift, driftItem{
+				Project:     c.Label(docker.LABEL_PROJECT),
+				Container:   name,
+				Problem:     DRIFT_ORPHANED,
+				Action:      ACTION_REMOVE,
+				ContainerId: c.Id,
+				Image:       c.Image,
+				State:       c.State,
+			})
+		}
+	}
+
+	sort.Slice(drift.Drift, func(i, j int) bool { return drift.Drift[i].Project < drift.Drift[j].Project })
+	drift.InSync = len(drift.Drift) == 0
+	return drift, nil
+}
+
+// Whether any service the container was started with has since moved.
+// Services deployed since aren't counted; they can be found through
+// discovery, and recreating every container on each new deploy would
+// be worse.
+func staleServices(c docker.Container, urls map[string]string, shortName string) (bool, error) {
+	current, err := data.ServiceVarsFromUrls(urls, shortName)
+	if err != nil {
+		return false, err
+	}
+	for name, value := range c.ServiceVars() {
+		if now, ok := current[name]; ok && now != value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Containers this goobernet made for environments that have since been
+// deleted, grouped by the environment they were made for. Nothing else
+// would ever clean them up.
+func findOrphanedEnvironments(environments []data.Environment) ([]*environmentDrift, error) {
+	containers, err := dockerClient.GetContainers(map[string]string{
+		docker.LABEL_INSTANCE: dockerClient.Instance(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(environments))
+	for _, e := range environments {
+		known[strings.ToLower(e.Name)] = true
+	}
+
+	byEnvironment := make(map[string]*environmentDrift)
+	orphaned := make([]*environmentDrift, 0)
+	for _, c := range containers {
+		name := c.Label(docker.LABEL_ENVIRONMENT)
+		if known[strings.ToLower(name)] {
+			continue
+		}
+		drift, ok := byEnvironment[name]
+		if !ok {
+			drift = &environmentDrift{Environment: name, Drift: make([]driftItem, 0, 5)}
+			byEnvironment[name] = drift
+			orphaned = append(orphaned, drift)
+		}
+		drift.Drift = append(drift.Drift, driftItem{
+			Project:     c.Label(docker.LABEL_PROJECT),
+			Container:   c.Name,
+			Problem:     DRIFT_ORPHANED,
+			Action:      ACTION_REMOVE,
+			ContainerId: c.Id,
+			Image:       c.Image,
+			State:       c.State,
+		})
+	}
+	sort.Slice(orphaned, func(i, j int) bool { return orphaned[i].Environment < orphaned[j].Environment })
+	return orphaned, nil
+}
+
+// Brings the environment's containers back in line with its deployments
+func reconcile(environment data.Environment) error {
+	deployLock.Lock()
+	defer deployLock.Unlock()
+
+	drift, err := findDrift(environment)
+	if err != nil {
+		return err
+	}
+	fixDrift(drift)
+	return nil
+}
+
+// Removes the containers of deleted environments
+func reconcileDeletedEnvironments() error {
+	deployLock.Lock()
+	defer deployLock.Unlock()
+
+	environments, err := store.GetEnvironments()
+	if err != nil {
+		return err
+	}
+	orphaned, err := findOrphanedEnvironments(environments)
+	if err != nil {
+		return err
+	}
+	for _, drift := range orphaned {
+		fixDrift(drift)
+	}
+	return nil
+}
+
+// Acts on each item. Errors are logged so one item can't hold up the rest.
+func fixDrift(drift *environmentDrift) {
+	for _, item := range drift.Drift {
+		fmt.Printf("Reconciling %s in %s: %s, will %s\n", item.Project, drift.Environment, item.Problem, item.Action)
+
+		var err error
+		switch item.Action {
+		case ACTION_CREATE:
+			// redeploy what was running, only falling back to latest
+			// for deployments with no history
+			tag, recordedTag := docker.DEFAULT_TAG, docker.DEFAULT_TAG
+			if item.revision != nil {
+				tag, recordedTag = revisionTag(*item.revision), item.revision.Tag
+			}
+			var resp *deployResponse
+			if resp, err = runDeployment(*item.deployment, tag, nil, recreate, ioutil.Discard); err == nil {
+				recordRevision(resp, recordedTag, "reconciler", 0)
+				for _, warning := range resp.Warnings {
+					fmt.Fprintf(os.Stderr, "Warning reconciling %s in %s: %s\n", item.Project, drift.Environment, warning)
+				}
+			}
+		case ACTION_RECREATE:
+			_, err = replaceContainer(*item.deployment, item.Image, nil)
+		case ACTION_REMOVE:
+			dockerClient.StopContainer(item.ContainerId, stopTimeout)
+			err = dockerClient.RemoveContainer(item.ContainerId, true)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reconciling %s in %s: %s\n", item.Project, drift.Environment, err.Error())
+		}
+	}
+}
+
+// Reconciles every environment every interval, until the process exits
+func startReconciler(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			environments, err := store.GetEnvironments()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading environments to reconcile: %s\n", err.Error())
+				continue
+			}
+			for _, environment := range environments {
+				if err := reconcile(environment); err != nil {
+					fmt.Fprintf(os.Stderr, "Error reconciling %s: %s\n", environment.Name, err.Error())
+				}
+			}
+			if err := reconcileDeletedEnvironments(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error removing containers of deleted environments: %s\n", err.Error())
+			}
+		}
+	}()
+}
+
+// handles GET /v1/environments/(environment-name)/drift
+func driftHandler(environmentName string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	environment, err := store.GetEnvironmentByName(environmentName)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+
+	drift, err := findDrift(environment)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error comparing deployments with containers: %s\n", err.Error())
+		return
+	}
+	marshalAndWrite(drift, w)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/travissimon/goobernet/data"
+	"github.com/travissimon/goobernet/docker"
+)
+
+// A store whose list reads fail, as a database might part way through
+type failingReadStore struct {
+	data.Store
+}
+
+var errRead = errors.New("disk I/O error")
+
+func (s failingReadStore) GetDeployments() ([]data.Deployment, error) {
+	return nil, errRead
+}
+
+func (s failingReadStore) GetEnvironments() ([]data.Environment, error) {
+	return nil, errRead
+}
+
+func TestReconcileRemovesNothingAfterAFailedRead(t *testing.T) {
+	memory := data.NewMemoryStore(data.DefaultConfig())
+	environment, err := memory.AddEnvironment(data.Environment{Name: "dev", Hostname: "localhost", StartingPort: 8000, Registry: "registry:5000"})
+	if err != nil {
+		t.Fatalf("AddEnvironment: %s", err)
+	}
+
+	// with no docker client, any attempt to look at or remove
+	// containers panics
+	oldStore, oldDocker := store, dockerClient
+	store, dockerClient = failingReadStore{memory}, nil
+	defer func() { store, dockerClient = oldStore, oldDocker }()
+
+	if err := reconcile(environment); err != errRead {
+		t.Errorf("reconcile = %v, want the read error", err)
+	}
+	if err := reconcileDeletedEnvironments(); err != errRead {
+		t.Errorf("reconcileDeletedEnvironments = %v, want the read error", err)
+	}
+	if _, err := findDrift(environment); err != errRead {
+		t.Errorf("findDrift = %v, want the read error", err)
+	}
+}
+
+func TestStaleServices(t *testing.T) {
+	urls := map[string]string{"billing": "localhost:8000", "ledger": "localhost:8005", "mail": "localhost:8002"}
+	labelled := func(services string) docker.Container {
+		return docker.Container{Labels: []docker.Label{{Name: docker.LABEL_SERVICES, Value: services}}}
+	}
+
+	tests := []struct {
+		name      string
+		container docker.Container
+		want      bool
+	}{
+		{"current", labelled("LEDGER_SERVICE_HOST=localhost,LEDGER_SERVICE_PORT=8005,MAIL_SERVICE_HOST=localhost,MAIL_SERVICE_PORT=8002"), false},
+		{"moved by a blue/green deploy", labelled("LEDGER_SERVICE_HOST=localhost,LEDGER_SERVICE_PORT=8001"), true},
+		{"deployed since", labelled("MAIL_SERVICE_HOST=localhost,MAIL_SERVICE_PORT=8002"), false},
+		{"undeployed since", labelled("SEARCH_SERVICE_HOST=localhost,SEARCH_SERVICE_PORT=8003"), false},
+		{"created before labelling", docker.Container{}, false},
+	}
+	for _, test := range tests {
+		stale, err := staleServices(test.container, urls, "billing")
+		if err != nil || stale != test.want {
+			t.Errorf("%s: staleServices = %v, %v; want %v", test.name, stale, err, test.want)
+		}
+	}
+}
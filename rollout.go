@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/travissimon/goobernet/data"
+	"github.com/travissimon/goobernet/docker"
+	"github.com/travissimon/goobernet/health"
+)
+
+// How a deployment's running container is replaced
+const (
+	// stop the old container, then start the new one on the same port
+	STRATEGY_RECREATE = "recreate"
+	// start the new container on another port, and only move the
+	// deployment over once it's healthy
+	STRATEGY_BLUE_GREEN = "bluegreen"
+
+	DEFAULT_HEALTH_TIMEOUT = time.Minute
+	// every other deploy waits on the lock meanwhile
+	MAX_HEALTH_TIMEOUT = 10 * time.Minute
+
+	// tries at each rename while swapping the containers over
+	SWAP_ATTEMPTS = 3
+)
+
+type rollout struct {
+	Strategy string
+	// HTTP path that must answer 2xx or 3xx; without one the project's
+	// health check is used, and failing that the service only has to
+	// accept connections
+	HealthPath    string
+	HealthTimeout time.Duration
+}
+
+var recreate = rollout{Strategy: STRATEGY_RECREATE}
+
+// ?strategy=recreate|bluegreen, ?healthPath= and ?healthTimeout=
+func parseRollout(r *http.Request) (rollout, error) {
+	query := r.URL.Query()
+	ro := rollout{
+		Strategy:      query.Get("strategy"),
+		HealthPath:    query.Get("healthPath"),
+		HealthTimeout: DEFAULT_HEALTH_TIMEOUT,
+	}
+	switch ro.Strategy {
+	case "":
+		ro.Strategy = STRATEGY_RECREATE
+	case STRATEGY_RECREATE, STRATEGY_BLUE_GREEN:
+	default:
+		return ro, fmt.Errorf("Unknown strategy '%s', expected %s or %s", ro.Strategy, STRATEGY_RECREATE, STRATEGY_BLUE_GREEN)
+	}
+	if timeout := query.Get("healthTimeout"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			return ro, fmt.Errorf("'%s' is not a valid health timeout", timeout)
+		}
+		if d > MAX_HEALTH_TIMEOUT {
+			return ro, fmt.Errorf("Health timeout %s is longer than the maximum of %s", d, MAX_HEALTH_TIMEOUT)
+		}
+		ro.HealthTimeout = d
+	}
+	return ro, nil
+}
+
+// The name the new container runs under until it takes over
+func nextContainerName(deployment data.Deployment) string {
+	return docker.DeploymentContainerName(deployment) + "-next"
+}
+
+// The name the old container is moved to while the new one takes over
+func oldContainerName(deployment data.Deployment) string {
+	return docker.DeploymentContainerName(deployment) + "-old"
+}
+
+// Starts imageRef on a free port alongside the running container. Once
+// it's healthy the containers swap names, the deployment moves to the
+// new port and the old container is removed. If any of that fails the
+// new container is removed and the old one carries on. The caller
+// holds deployLock, which keeps the free port from being handed out
+// to another deployment meanwhile.
+func blueGreenContainer(deployment data.Deployment, imageRef string, values map[string]string, ro rollout) (*deployResponse, error) {
+	existing, err := dockerClient.FindContainer(docker.DeploymentContainerName(deployment))
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil || !existing.State.Running {
+		// nothing is being served, so there's nothing to keep up
+		return replaceContainer(deployment, imageRef, values)
+	}
+
+	deployments, err := store.GetDeployments()
+	if err != nil {
+		return nil, err
+	}
+	port, err := data.NextFreePort(deployment.Environment, deployments)
+	if err != nil {
+		return nil, err
+	}
+	next := deployment
+	next.Port = port
+
+	// left over from an attempt that died part way through
+	for _, name := range []string{nextContainerName(deployment), oldContainerName(deployment)} {
+		if leftover, err := dockerClient.FindContainer(name); err == nil && leftover != nil {
+			dockerClient.RemoveContainer(leftover.ID, true)
+		}
+	}
+
+	container, err := dockerClient.CreateDeploymentContainer(store, next, nextContainerName(deployment), imageRef, values)
+	if err != nil {
+		return nil, err
+	}
+	rollback := func() {
+		dockerClient.StopContainer(container.ID, stopTimeout)
+		if err := dockerClient.RemoveContainer(container.ID, true); err != nil {
+			fmt.Fprintf(os.Stderr, "Error removing new container %s: %s\n", container.ID, err.Error())
+		}
+	}
+
+	if err := dockerClient.StartContainer(container.ID); err != nil {
+		rollback()
+		return nil, err
+	}
+	if err := waitHealthy(next, nextContainerName(deployment), ro); err != nil {
+		rollback()
+		return nil, fmt.Errorf("New container never became healthy, %s is still running: %s", existing.ID, err.Error())
+	}
+
+	// the old container keeps serving until the deployment has moved,
+	// so failing at any step only needs the new one taking away
+	name := docker.DeploymentContainerName(deployment)
+	restore := func() {
+		rollback()
+		if err := renameContainer(existing.ID, name); err != nil {
+			fmt.Fprintf(os.Stderr, "Error renaming old container %s back to %s: %s\n", existing.ID, name, err.Error())
+		}
+		if err := dockerClient.StartContainer(existing.ID); err != nil {
+			fmt.Fprintf(os.Stderr, "Error restarting old container %s: %s\n", existing.ID, err.Error())
+		}
+	}
+	if err := renameContainer(existing.ID, oldContainerName(deployment)); err != nil {
+		rollback()
+		return nil, fmt.Errorf("Couldn't move %s aside, it's still running: %s", existing.ID, err.Error())
+	}
+	if err := renameContainer(container.ID, name); err != nil {
+		restore()
+		return nil, fmt.Errorf("Couldn't rename the new container, %s is still running: %s", existing.ID, err.Error())
+	}
+	moved, err := store.SetDeploymentPort(deployment.Environment.Id, deployment.Project.Id, port)
+	if err != nil {
+		restore()
+		return nil, err
+	}
+
+	// anything left is an orphan, which the reconciler removes
+	dockerClient.StopContainer(existing.ID, stopTimeout)
+	if err := dockerClient.RemoveContainer(existing.ID, true); err != nil {
+		fmt.Fprintf(os.Stderr, "Error removing old container %s: %s\n", existing.ID, err.Error())
+	}
+
+	status := "created"
+	if started, err := dockerClient.FindContainer(container.ID); err == nil && started != nil {
+		status = started.State.Status
+	}
+	return &deployResponse{
+		deploymentResponse: newDeploymentResponse(moved),
+		Image:              imageRef,
+		ContainerId:        container.ID,
+		Status:             status,
+		values:             values,
+	}, nil
+}
+
+// Renames the container, retrying in case docker is still busy with it
+func renameContainer(id, name string) error {
+	var err error
+	for attempt := 0; attempt < SWAP_ATTEMPTS; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Second)
+		}
+		if err = dockerClient.RenameContainer(id, name); err == nil {
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "Error renaming container %s to %s: %s\n", id, name, err.Error())
+	}
+	return err
+}
+
+// The check a new container has to pass before it takes over
+func (ro rollout) healthCheck(project data.Project) data.HealthCheck {
+	if ro.HealthPath != "" {
+		return data.HealthCheck{Type: data.HEALTH_HTTP, Path: ro.HealthPath}
+	}
+	if project.HealthCheck.Enabled() {
+		return project.HealthCheck
+	}
+	return data.HealthCheck{Type: data.HEALTH_TCP}
+}
+
+// Probes the deployment's container until it passes or the rollout's
+// health timeout has passed
+func waitHealthy(deployment data.Deployment, container string, ro rollout) error {
+	check := ro.healthCheck(deployment.Project)
+	deadline := time.Now().Add(ro.HealthTimeout)
+
+	var err error
+	for time.Now().Before(deadline) {
+		ctx, cancel := context.WithTimeout(context.Background(), check.TimeoutDuration())
+		err = health.Probe(ctx, dockerClient, check, deployment.Environment.Hostname, deployment.Port, container)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("Not healthy after %s: %v", ro.HealthTimeout, err)
+}
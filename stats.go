@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/travissimon/goobernet/data"
+	"github.com/travissimon/goobernet/docker"
+)
+
+const STATS_SEGMENT = "stats"
+
+type environmentStats struct {
+	Environment string         `json:"environment"`
+	Total       docker.Stats   `json:"total"`
+	Containers  []docker.Stats `json:"containers"`
+	// deployments with no container to sample
+	Missing []string `json:"missing,omitempty"`
+}
+
+// handles GET /v1/containers/(id or name)/stats
+func handleContainerStats(id string, w http.ResponseWriter) {
+	stats, err := dockerClient.GetStats(id)
+	if err != nil {
+		if docker.IsNoSuchContainer(err) {
+			writeError(w, http.StatusNotFound, "Unable to find container: %s\n", id)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Error reading container stats: %s\n", err.Error())
+		return
+	}
+	marshalAndWrite(stats, w)
+}
+
+// handles GET /v1/environments/(environment-name)/stats, sampling the
+// container of every deployment in the environment
+func environmentStatsHandler(environmentName string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	environment, err := store.GetEnvironmentByName(environmentName)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+
+	all, err := store.GetDeployments()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%s\n", err.Error())
+		return
+	}
+	var deployments []data.Deployment
+	for _, d := range all {
+		if d.Environment.Id == environment.Id {
+			deployments = append(deployments, d)
+		}
+	}
+
+	resp := environmentStats{Environment: environment.Name, Containers: make([]docker.Stats, 0, len(deployments))}
+
+	// each sample takes a second or so, so take them all at once
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, d := range deployments {
+		wg.Add(1)
+		go func(d data.Deployment) {
+			defer wg.Done()
+			stats, err := dockerClient.GetStats(docker.DeploymentContainerName(d))
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				resp.Missing = append(resp.Missing, d.Project.ShortName)
+				return
+			}
+			resp.Containers = append(resp.Containers, *stats)
+			resp.Total.Add(*stats)
+		}(d)
+	}
+	wg.Wait()
+
+	sort.Slice(resp.Containers, func(i, j int) bool { return resp.Containers[i].Name < resp.Containers[j].Name })
+	sort.Strings(resp.Missing)
+	marshalAndWrite(resp, w)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/travissimon/goobernet/ci"
+	"github.com/travissimon/goobernet/data"
+)
+
+const (
+	TEMPLATES_PATH = "/v1/templates/"
+	RENDER_SUFFIX  = "/render"
+)
+
+// handles requests for /v1/templates
+func templatesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		getTemplatesHandler(w, r)
+	case "POST":
+		handlePostTemplate(w, r)
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+// handles requests for /v1/templates/(template-name)
+// and /v1/templates/(template-name)/render
+func templateHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path[len(TEMPLATES_PATH):]
+
+	if strings.HasSuffix(name, RENDER_SUFFIX) {
+		name = name[:len(name)-len(RENDER_SUFFIX)]
+		if r.Method != "POST" {
+			writeMethodNotAllowed(w, r)
+			return
+		}
+		handleRenderTemplate(name, w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		handleGetTemplate(name, w)
+	case "PUT":
+		handlePutTemplate(name, w, r)
+	case "DELETE":
+		handleDeleteTemplate(name, w)
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+func getTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	templates, err := store.GetTemplates()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%s\n", err.Error())
+		return
+	}
+	marshalAndWrite(templates, w)
+}
+
+func handleGetTemplate(name string, w http.ResponseWriter) {
+	template, err := store.GetTemplateByName(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+	marshalAndWrite(template, w)
+}
+
+func handlePostTemplate(w http.ResponseWriter, r *http.Request) {
+	var template data.JenkinsTemplate
+	if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+		writeError(w, http.StatusBadRequest, "Error decoding template json: %s\n", err.Error())
+		return
+	}
+	if err := data.ValidateTemplate(template); err != nil {
+		writeError(w, http.StatusBadRequest, "%s\n", err.Error())
+		return
+	}
+	if err := store.AddTemplate(template); err != nil {
+		writeError(w, http.StatusConflict, "Error saving template: %s\n", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	marshalAndWrite(template, w)
+}
+
+func handlePutTemplate(name string, w http.ResponseWriter, r *http.Request) {
+	if _, err := store.GetTemplateByName(name); err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+
+	var template data.JenkinsTemplate
+	if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+		writeError(w, http.StatusBadRequest, "Error decoding template json: %s\n", err.Error())
+		return
+	}
+	template.Name = name
+	if err := data.ValidateTemplate(template); err != nil {
+		writeError(w, http.StatusBadRequest, "%s\n", err.Error())
+		return
+	}
+	if err := store.UpdateTemplate(template); err != nil {
+		writeError(w, http.StatusInternalServerError, "Error saving template: %s\n", err.Error())
+		return
+	}
+	marshalAndWrite(template, w)
+}
+
+func handleDeleteTemplate(name string, w http.ResponseWriter) {
+	if err := store.DeleteTemplate(name); err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// renders the template against the posted project without creating a job
+func handleRenderTemplate(name string, w http.ResponseWriter, r *http.Request) {
+	template, err := store.GetTemplateByName(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s\n", err.Error())
+		return
+	}
+
+	var project data.Project
+	if err := json.NewDecoder(r.Body).Decode(&project); err != nil {
+		writeError(w, http.StatusBadRequest, "Error decoding project json: %s\n", err.Error())
+		return
+	}
+
+	marshalAndWrite(ci.RenderTemplate(*template, project), w)
+}